@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base58btc/mailer/mail"
+)
+
+/* Commands for looking after the mailer from a shell, rather than
+ * opening the database by hand. Changes they make are audited as
+ * cli:<user> */
+
+func cliClient() string {
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	return "cli:" + name
+}
+
+/* The -state, -job, -missive, -from and -to flags export and list
+ * share. Call the func once flags are parsed for the filter */
+func filterFlags(flags *flag.FlagSet) func() (*mail.MailFilter, error) {
+	var filter mail.MailFilter
+	var state, from, to string
+
+	flags.StringVar(&state, "state", "", "only mail in this state")
+	flags.StringVar(&filter.JobKey, "job", "", "only mail for this job key")
+	flags.StringVar(&filter.Missive, "missive", "", "only mail in this missive")
+	flags.StringVar(&from, "from", "", "only mail to send at or after this")
+	flags.StringVar(&to, "to", "", "only mail to send before this")
+
+	return func() (*mail.MailFilter, error) {
+		var err error
+		filter.State = mail.ScheduleState(state)
+		if from != "" {
+			if filter.SendFrom, err = parseWhen(from); err != nil {
+				return nil, fmt.Errorf("-from: %s", err)
+			}
+		}
+		if to != "" {
+			if filter.SendTo, err = parseWhen(to); err != nil {
+				return nil, fmt.Errorf("-to: %s", err)
+			}
+		}
+		return &filter, nil
+	}
+}
+
+/* mailer schedule <file>. The file holds a MailRequest, as you'd PUT
+ * to /job, or a list of them; - reads stdin */
+func schedule(e *env, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: schedule <file>")
+	}
+
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := []json.RawMessage{ data }
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err = json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+	}
+
+	jobs := make([]mail.MailRequest, len(entries))
+	for i, entry := range entries {
+		if err = mail.DecodeMailRequest(entry, &jobs[i], e.AttachmentPolicy); err != nil {
+			return fmt.Errorf("mail %d: %s", i + 1, err)
+		}
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+
+	/* Check them all before scheduling any */
+	mails := make([]*mail.Mail, len(jobs))
+	for i, job := range jobs {
+		if mails[i], err = mail.ConvertMailRequest(job); err != nil {
+			return fmt.Errorf("mail %d: %s", i + 1, err)
+		}
+		if err = mail.CheckRequest(ds, e.AttachmentPolicy, mails[i]); err != nil {
+			return fmt.Errorf("mail %d: %s", i + 1, err)
+		}
+	}
+
+	for _, m := range mails {
+		replayed, err := mail.ScheduleRequest(ds, m)
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.IdemKey(), err)
+		}
+		if replayed {
+			fmt.Println(m.IdemKey())
+			continue
+		}
+		mail.Audit(ds, cliClient(), "", "schedule", string(mail.PauseMail), m.IdemKey(), 1)
+		fmt.Println(m.IdemKey())
+	}
+	return nil
+}
+
+/* mailer list [-state s] [-job k] [-missive m] [-from t] [-to t] [-limit n] */
+func list(e *env, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	getFilter := filterFlags(flags)
+	limit := flags.Int("limit", 50, "list at most this many")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	filter, err := getFilter()
+	if err != nil {
+		return err
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IDEM KEY\tSTATE\tSEND AT\tTRIES\tJOB\tTITLE")
+	count, after := 0, ""
+	for count < *limit {
+		mails, err := ds.FindMails(filter, after, min(100, *limit - count))
+		if err != nil {
+			return err
+		}
+		if len(mails) == 0 {
+			break
+		}
+		for _, m := range mails {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", m.IdemKey(), m.State,
+				time.Time(m.SendAt).Format(time.RFC3339), m.TryCount, m.JobKey, m.Title)
+		}
+		count += len(mails)
+		after = mails[len(mails) - 1].IdemKey()
+	}
+	return tw.Flush()
+}
+
+/* mailer show <idem_key> */
+func show(e *env, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: show <idem_key>")
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+	m, err := ds.GetMail(args[0])
+	if err != nil {
+		return fmt.Errorf("No mail %s: %s", args[0], err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	field := func(name string, value interface{}) {
+		fmt.Fprintf(tw, "%s:\t%v\n", name, value)
+	}
+	optional := func(name string, value string, valid bool) {
+		if valid {
+			field(name, value)
+		}
+	}
+
+	field("idem key", m.IdemKey())
+	field("job", m.JobKey)
+	optional("subscription", m.Sub.String, m.Sub.Valid)
+	optional("missive", m.Missive.String, m.Missive.Valid)
+	field("to", m.ToAddr)
+	optional("to name", m.ToName.String, m.ToName.Valid)
+	optional("from", m.FromAddr.String, m.FromAddr.Valid)
+	optional("from name", m.FromName.String, m.FromName.Valid)
+	optional("reply to", m.ReplyTo.String, m.ReplyTo.Valid)
+	field("title", m.Title)
+	field("send at", time.Time(m.SendAt).Format(time.RFC3339))
+	if m.ExpiresAt.Valid {
+		field("expires at", time.Unix(m.ExpiresAt.Int64, 0).Format(time.RFC3339))
+	}
+	field("state", m.State)
+	field("tries", m.TryCount)
+	field("priority", m.Priority)
+	optional("domain", m.Domain, m.Domain != "")
+	optional("provider id", m.ProviderID.String, m.ProviderID.Valid)
+	optional("last error", m.LastError.String, m.LastError.Valid)
+	for _, a := range m.Attachments {
+		field("attachment", fmt.Sprintf("%s (%s, %d bytes)", a.Name, a.Type, len(a.Content)))
+	}
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n--- text ---\n%s\n", m.TextBody)
+	fmt.Printf("\n--- html ---\n%s\n", m.HTMLBody)
+	return nil
+}
+
+/* mailer cancel <idem_key>... | -job k | -missive m | -sub s
+ * Cancelling a job or subscription leaves mail that's in flight be,
+ * the same as the API does */
+func cancel(e *env, args []string) error {
+	flags := flag.NewFlagSet("cancel", flag.ContinueOnError)
+	job := flags.String("job", "", "cancel this job's unsent mail")
+	missive := flags.String("missive", "", "cancel this missive's unsent mail")
+	sub := flags.String("sub", "", "cancel this subscription's unsent mail")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	given := 0
+	for _, v := range []string{*job, *missive, *sub} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 || (given == 1) == (flags.NArg() > 0) {
+		return fmt.Errorf("usage: cancel <idem_key>... | -job k | -missive m | -sub s")
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	switch {
+	case *job != "":
+		count, err = ds.DeleteJob(*job)
+		mail.Audit(ds, cliClient(), "", "cancel", string(mail.PauseJob), *job, count)
+	case *missive != "":
+		count, err = ds.CancelMissive(*missive)
+		mail.Audit(ds, cliClient(), "", "cancel", string(mail.PauseMissive), *missive, count)
+	case *sub != "":
+		count, err = ds.DeleteSubscription(*sub)
+		mail.Audit(ds, cliClient(), "", "cancel", string(mail.PauseSubscription), *sub, count)
+	default:
+		for _, key := range flags.Args() {
+			var n int64
+			if n, err = ds.CancelMail(key); err != nil {
+				break
+			}
+			if n == 0 {
+				fmt.Fprintf(os.Stderr, "%s: no such mail, or it's been sent\n", key)
+			}
+			mail.Audit(ds, cliClient(), "", "cancel", string(mail.PauseMail), key, n)
+			count += n
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Cancelled %d mails\n", count)
+	return nil
+}
+
+/* mailer retry <idem_key>... Failed or expired mail goes out now */
+func retry(e *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: retry <idem_key>...")
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	for _, key := range args {
+		n, err := ds.RetryMail(key, time.Now())
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no failed or expired mail\n", key)
+			continue
+		}
+		mail.Audit(ds, cliClient(), "", "retry", string(mail.PauseMail), key, n)
+		count += n
+	}
+
+	fmt.Printf("Retrying %d mails\n", count)
+	return nil
+}
+
+/* mailer config check. Looks over the settings and the database
+ * without changing anything, and fails if the mailer wouldn't run */
+func config(e *env, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("usage: config check")
+	}
+
+	var problems, warnings []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	warn := func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}
+
+	for name, value := range map[string]string{
+		"HMAC_SECRET": e.Secret,
+		"MAIL_DOMAINS": e.MailDomains,
+		"MAILGUN_KEY": e.MailGunKey,
+		"PORT": e.Port,
+	} {
+		if strings.TrimSpace(value) == "" {
+			problem("%s isn't set", name)
+		}
+	}
+	if e.SendTimer <= 0 {
+		problem("MAIL_SEND_TIMER must be more than 0")
+	}
+	if e.EncryptionKeys != "" {
+		if _, err := mail.ParseKeyring(e.EncryptionKeys, e.EncryptionKeyID); err != nil {
+			problem("ENCRYPTION_KEYS: %s", err)
+		}
+	}
+	if e.DashboardPassword != "" && len(e.DashboardPassword) < 12 {
+		warn("DASHBOARD_PASSWORD is short; it's all that guards the dashboard")
+	}
+	if max := e.AttachmentPolicy.MaxMessageBytes; max == 0 || max > 25 << 20 {
+		warn("MAIL_MAX_BYTES lets through mail over Mailgun's 25MB limit, which it'll refuse at send time")
+	}
+	if e.IsProd && e.MetricsToken == "" {
+		problem("METRICS_TOKEN must be set in PROD, or /metrics is open")
+	}
+
+	if e.DevStore {
+		if e.IsProd {
+			problem("DATASTORE=memory isn't for PROD")
+		}
+	} else if mg, err := mail.MigratorNew(e.DbName); err != nil {
+		problem("Unable to open %s: %s", e.DbName, err)
+	} else {
+		defer mg.Close()
+		status, err := mg.Status()
+		if err != nil {
+			problem("Unable to read migrations from %s: %s", e.DbName, err)
+		}
+		pending := 0
+		for _, s := range status {
+			switch s.State {
+			case "pending":
+				pending++
+			case "edited":
+				warn("Migration %d (%s) has changed since it was applied", s.Version, s.Name)
+			case "unknown":
+				problem("%s has migration %d (%s), which this mailer doesn't know about", e.DbName, s.Version, s.Name)
+			}
+		}
+		if pending > 0 {
+			warn("%d migrations pending; they'll be applied on start", pending)
+		}
+	}
+
+	for _, w := range warnings {
+		fmt.Println("warning:", w)
+	}
+	for _, p := range problems {
+		fmt.Println("error:", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("Config ok")
+	return nil
+}
+
+/* mailer attach encode [-name n] [-type t] <file>...
+ * mailer attach decode [-set] [-dir d] [file]
+ * For working with the attachment encoding (see Attachment in
+ * mail/types.go) without a mailer to hand; it doesn't need the env */
+func attach(e *env, args []string) error {
+	usage := fmt.Errorf("usage: attach encode [-name n] [-type t] <file>... | attach decode [-set] [-dir d] [file]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "encode":
+		return attachEncode(args[1:])
+	case "decode":
+		return attachDecode(args[1:])
+	}
+	return usage
+}
+
+/* Prints a JSON list of attachments entries, one per file */
+func attachEncode(args []string) error {
+	flags := flag.NewFlagSet("attach encode", flag.ContinueOnError)
+	name := flags.String("name", "", "name to give the file, rather than its own")
+	typ := flags.String("type", "", "content type, rather than sniffing it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: attach encode [-name n] [-type t] <file>...")
+	}
+	if *name != "" && flags.NArg() > 1 {
+		return fmt.Errorf("-name is for a single file")
+	}
+
+	entries := make([]string, 0, flags.NArg())
+	for _, path := range flags.Args() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		a := mail.Attachment{ Name: filepath.Base(path), Content: content }
+		if *name != "" {
+			a.Name = *name
+		}
+		a.Type = *typ
+		if a.Type == "" {
+			a.Type = mail.SniffType(a.Name, content)
+		}
+
+		entry, err := a.Encode()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		entries = append(entries, entry)
+		fmt.Fprintf(os.Stderr, "%s: %s, %s, %d bytes\n", path, a.Name, a.Type, len(content))
+	}
+
+	out, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+/* Reads attachments entries (one a line, or a JSON list of them), a
+ * stored attachment blob or, with -set, a stored AttachSet blob, and
+ * writes out the files in them */
+func attachDecode(args []string) error {
+	flags := flag.NewFlagSet("attach decode", flag.ContinueOnError)
+	set := flags.Bool("set", false, "input is an AttachSet blob")
+	dir := flags.String("dir", ".", "where to write the files")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: attach decode [-set] [-dir d] [file]")
+	}
+
+	var data []byte
+	var err error
+	if flags.NArg() == 0 || flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	var attachments mail.AttachSet
+	switch {
+	case *set:
+		err = attachments.Scan(data)
+	case bytes.HasPrefix(data, []byte{ 0x1f, 0x8b }):
+		/* gzip's magic number: a blob straight from the attachments table */
+		a := &mail.Attachment{}
+		err = a.Plump(data)
+		attachments = mail.AttachSet{ a }
+	default:
+		var entries []string
+		data = bytes.TrimSpace(data)
+		if bytes.HasPrefix(data, []byte("[")) {
+			err = json.Unmarshal(data, &entries)
+		} else {
+			entries = strings.Fields(string(data))
+		}
+		for i := 0; err == nil && i < len(entries); i++ {
+			var a *mail.Attachment
+			if a, err = mail.DecodeAttachment(entries[i]); err != nil {
+				err = fmt.Errorf("entry %d: %s", i + 1, err)
+			}
+			attachments = append(attachments, a)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, a := range attachments {
+		/* Names come from whoever made the attachment; keep them in dir */
+		name := filepath.Base(a.Name)
+		if name == "." || name == "/" || name == ".." {
+			name = fmt.Sprintf("attachment-%d", i + 1)
+		}
+		path := filepath.Join(*dir, name)
+		if err = os.WriteFile(path, a.Content, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s, %d bytes\n", path, a.Type, len(a.Content))
+	}
+	return nil
+}
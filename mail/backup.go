@@ -0,0 +1,212 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+/* A datastore that can snapshot itself. Only SQLiteStore can; there's
+ * nothing worth keeping in a MemStore. */
+type Backuper interface {
+	Backup(w io.Writer, gzipped bool) error
+}
+
+/* Write a consistent snapshot of the database to w. It's safe to take
+ * while the worker is writing. */
+func (ds *SQLiteStore) Backup(w io.Writer, gzipped bool) error {
+	tmp, err := os.CreateTemp("", "mailer-backup-*.db")
+	if err != nil {
+		return err
+	}
+	path := tmp.Name()
+	tmp.Close()
+	defer os.Remove(path)
+
+	if err = backupTo(ds.Data, path); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !gzipped {
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err = io.Copy(zw, f); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+/* Snapshot the database at dbConn without starting up a datastore on
+ * it, for the backup command */
+func BackupDatabase(dbConn string, w io.Writer, gzipped bool) error {
+	if _, err := os.Stat(dbConn); err != nil {
+		return err
+	}
+
+	db, err := sqlx.Open("sqlite3", dbConn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ds := &SQLiteStore{ Data: db }
+	return ds.Backup(w, gzipped)
+}
+
+/* Copy the database into the (empty) file at path with SQLite's online
+ * backup API */
+func backupTo(db *sqlx.DB, path string) error {
+	ctx := context.Background()
+	src, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dstDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dstDB.Close()
+
+	dst, err := dstDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return dst.Raw(func(dc interface{}) error {
+		return src.Raw(func(sc interface{}) error {
+			dstConn, ok := dc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Backups need a SQLite connection")
+			}
+			srcConn, ok := sc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Backups need a SQLite connection")
+			}
+
+			bk, err := dstConn.Backup("main", srcConn, "main")
+			if err != nil {
+				return err
+			}
+
+			/* All in one step, so nothing can change partway through */
+			if _, err = bk.Step(-1); err != nil {
+				bk.Finish()
+				return err
+			}
+			return bk.Finish()
+		})
+	})
+}
+
+/* Swap a snapshot, gzipped or not, in for the database at dbConn. The
+ * snapshot is checked first: it has to be an intact mailer database,
+ * and no newer than we are. Whatever was at dbConn is kept alongside,
+ * as dbConn + ".pre-restore".
+ *
+ * Stop the mailer before restoring. */
+func Restore(dbConn string, snapshot io.Reader) error {
+	var r io.Reader = bufio.NewReader(snapshot)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	/* Next to the database, so that swapping it in is a rename */
+	tmp, err := os.CreateTemp(filepath.Dir(dbConn), filepath.Base(dbConn) + ".restore-*")
+	if err != nil {
+		return err
+	}
+	path := tmp.Name()
+	defer os.Remove(path)
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = checkSnapshot(path); err != nil {
+		return err
+	}
+
+	/* A journal left beside the old database would be played into
+	 * the new one, so it goes too */
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		old := dbConn + suffix
+		if _, err = os.Stat(old); err != nil {
+			continue
+		}
+		if err = os.Rename(old, dbConn + ".pre-restore" + suffix); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(path, dbConn)
+}
+
+func checkSnapshot(path string) error {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err = db.Get(&result, `PRAGMA integrity_check`); err != nil {
+		return fmt.Errorf("Snapshot isn't a SQLite database: %s", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("Snapshot failed its integrity check: %s", result)
+	}
+
+	var tables int
+	stmt := `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name IN ('db_metadata', 'scheduled')`
+	if err = db.Get(&tables, stmt); err != nil {
+		return err
+	}
+	if tables != 2 {
+		return fmt.Errorf("Snapshot isn't a mailer database")
+	}
+
+	if err = setupTables(db); err != nil {
+		return err
+	}
+	status, err := migrationStatus(db)
+	if err != nil {
+		return err
+	}
+	for _, s := range status {
+		if s.State == "unknown" {
+			return fmt.Errorf("Snapshot has migration %d (%s), which we don't know about. Is it from a newer mailer?", s.Version, s.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	tt "testing"
+	"time"
+)
+
+func TestBackupRestore(t *tt.T) {
+	dir := t.TempDir()
+	ds, err := SQLiteStoreNew(filepath.Join(dir, "live.db"))
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+
+	m := &Mail{
+		JobKey: "backup",
+		ToAddr: "hi@example.com",
+		Title: "Still here",
+		TextBody: "hello!",
+		SendAt: Timestamp(time.Now()),
+	}
+	if err = ds.ScheduleMail(m); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+
+	for _, gzipped := range []bool{false, true} {
+		var snapshot bytes.Buffer
+		if err = ds.Backup(&snapshot, gzipped); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+
+		path := filepath.Join(dir, "restored.db")
+		if err = Restore(path, &snapshot); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+
+		restored, err := SQLiteStoreNew(path)
+		if err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		got, err := restored.GetMail(m.Idem)
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		if got.TextBody != m.TextBody {
+			t.Errorf("expecting %s, got %s", m.TextBody, got.TextBody)
+		}
+		restored.Data.Close()
+	}
+}
+
+func TestRestoreChecks(t *tt.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mail.db")
+
+	if err := Restore(path, bytes.NewReader([]byte("not a database"))); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	/* From a newer mailer than us */
+	ds := getDatastore(t)
+	ds.Data.MustExec(`INSERT INTO schema_migrations VALUES (9999, 'from_the_future', '', 0)`)
+	var snapshot bytes.Buffer
+	if err := ds.Backup(&snapshot, true); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if err := Restore(path, &snapshot); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(matches) != 0 {
+		t.Errorf("expecting nothing left behind, got %v", matches)
+	}
+}
+
+/* Fails partway through, or before it's written anything */
+type brokenBackup struct {
+	*MemStore
+	partial bool
+}
+
+func (b *brokenBackup) Backup(w io.Writer, gzipped bool) error {
+	if b.partial {
+		w.Write([]byte("SQLite format 3"))
+	}
+	return errors.New("disk went away")
+}
+
+func TestBackupFailure(t *tt.T) {
+	get := func(ds Datastore) (w *httptest.ResponseRecorder, aborted bool) {
+		w = httptest.NewRecorder()
+		defer func() {
+			aborted = recover() == http.ErrAbortHandler
+		}()
+		GetBackup(w, signedRequest("secret", "GET", "/backup", ""), ds, "secret")
+		return w, false
+	}
+
+	/* Before anything's sent, the error goes back as JSON */
+	w, aborted := get(&brokenBackup{ MemStore: MemStoreNew() })
+	var ret ReturnVal
+	if aborted || json.Unmarshal(w.Body.Bytes(), &ret) != nil || ret.Success {
+		t.Errorf("expecting a JSON error, got %q", w.Body.String())
+	}
+	if w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("expecting no file, got %s", w.Header().Get("Content-Disposition"))
+	}
+
+	/* After, nothing's tacked on the end; the connection's dropped */
+	w, aborted = get(&brokenBackup{ MemStore: MemStoreNew(), partial: true })
+	if !aborted {
+		t.Errorf("expecting the connection dropped")
+	}
+	if w.Body.String() != "SQLite format 3" {
+		t.Errorf("expecting only the backup, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"sync"
+	"time"
+)
+
+/* Breaker is a circuit breaker for a mail provider. After threshold
+ * sends in a row fail it opens, and the worker stops handing the
+ * provider mail for cooldown. Then it's half open: one send is let
+ * through, and whether it works closes the breaker or opens it again. */
+type Breaker struct {
+	mu sync.Mutex
+	threshold int
+	cooldown time.Duration
+	failures int
+	openUntil time.Time
+}
+
+const (
+	CircuitClosed = "closed"
+	CircuitOpen = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown: cooldown,
+	}
+}
+
+/* Whether a send should be tried now */
+func (b *Breaker) Allow(now time.Time) bool {
+	return b.State(now) != CircuitOpen
+}
+
+/* Note how a send went. Only failures that are the provider's
+ * problem, not the mail's, should count. */
+func (b *Breaker) Record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+func (b *Breaker) State(now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.failures < b.threshold:
+		return CircuitClosed
+	case now.Before(b.openUntil):
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+/* When an open breaker goes half open */
+func (b *Breaker) RetryAt() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openUntil
+}
@@ -0,0 +1,150 @@
+package mail
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+/* Keyring holds the AES-256-GCM keys that mail contents are encrypted
+ * with at rest. New data is always sealed with the current key; older
+ * keys are kept around so what they sealed can still be opened, until
+ * it's been re-encrypted.
+ *
+ * A nil Keyring is valid, and leaves everything in the clear. */
+type Keyring struct {
+	current string
+	keys map[string]cipher.AEAD
+}
+
+/* Parse keys given as "id:base64key,id:base64key". Each key must be 32
+ * bytes. current names the key to encrypt with; if there's only the
+ * one key it can be left blank. */
+func ParseKeyring(spec string, current string) (*Keyring, error) {
+	kr := &Keyring{
+		current: current,
+		keys: make(map[string]cipher.AEAD),
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("Key entries must look like id:base64key")
+		}
+		if _, dup := kr.keys[id]; dup {
+			return nil, fmt.Errorf("Key %s given twice", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s isn't valid base64: %s", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Key %s is %d bytes, expected 32", id, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+	}
+
+	if len(kr.keys) == 0 {
+		return nil, fmt.Errorf("No keys given")
+	}
+
+	if kr.current == "" {
+		if len(kr.keys) > 1 {
+			return nil, fmt.Errorf("Several keys given, say which is current")
+		}
+		for id := range kr.keys {
+			kr.current = id
+		}
+	}
+	if _, ok := kr.keys[kr.current]; !ok {
+		return nil, fmt.Errorf("Current key %s isn't one of the keys given", kr.current)
+	}
+
+	return kr, nil
+}
+
+/* The id of the key new data is sealed with; blank if there's no keyring */
+func (kr *Keyring) Current() string {
+	if kr == nil {
+		return ""
+	}
+	return kr.current
+}
+
+/* Encrypt with the current key. aad ties the result to where it's
+ * stored, so it can't be swapped into another row. Empty input stays
+ * empty, so that "is there a body" can still be answered in SQL. */
+func (kr *Keyring) Seal(plain []byte, aad string) ([]byte, string, error) {
+	if kr == nil || len(plain) == 0 {
+		return plain, "", nil
+	}
+
+	aead := kr.keys[kr.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(plain) + aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+
+	return aead.Seal(nonce, nonce, plain, []byte(aad)), kr.current, nil
+}
+
+/* Decrypt what Seal gave back. A blank keyID means it was never sealed */
+func (kr *Keyring) Open(sealed []byte, keyID string, aad string) ([]byte, error) {
+	if keyID == "" || len(sealed) == 0 {
+		return sealed, nil
+	}
+	if kr == nil {
+		return nil, fmt.Errorf("Data is encrypted with key %s, but there's no keyring", keyID)
+	}
+
+	aead, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Data is encrypted with key %s, which isn't in the keyring", keyID)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted data is truncated")
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(aad))
+}
+
+/* Text columns hold sealed data as base64 */
+func (kr *Keyring) SealString(plain string, aad string) (string, string, error) {
+	sealed, keyID, err := kr.Seal([]byte(plain), aad)
+	if err != nil || keyID == "" {
+		return string(sealed), keyID, err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), keyID, nil
+}
+
+func (kr *Keyring) OpenString(sealed string, keyID string, aad string) (string, error) {
+	if keyID == "" || sealed == "" {
+		return sealed, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	plain, err := kr.Open(data, keyID, aad)
+	return string(plain), err
+}
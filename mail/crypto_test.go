@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"encoding/base64"
+	"strings"
+	tt "testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestKeyring(t *tt.T) {
+	bad := []struct{ spec, current string }{
+		{"", ""},
+		{"k1", ""},
+		{"k1:notbase64!", ""},
+		{"k1:" + base64.StdEncoding.EncodeToString([]byte("short")), ""},
+		{"k1:" + testKey('a') + ",k1:" + testKey('b'), "k1"},
+		{"k1:" + testKey('a') + ",k2:" + testKey('b'), ""},
+		{"k1:" + testKey('a'), "k2"},
+	}
+	for _, b := range bad {
+		if _, err := ParseKeyring(b.spec, b.current); err == nil {
+			t.Errorf("expecting err for %q (current %q)", b.spec, b.current)
+		}
+	}
+
+	kr, err := ParseKeyring("k1:" + testKey('a'), "")
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	if kr.Current() != "k1" {
+		t.Errorf("expecting current key %s, got %s", "k1", kr.Current())
+	}
+
+	sealed, keyID, err := kr.SealString("hello!", "mail:text_body")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if keyID != "k1" || sealed == "hello!" {
+		t.Errorf("expecting sealed under k1, got %s under %s", sealed, keyID)
+	}
+
+	plain, err := kr.OpenString(sealed, keyID, "mail:text_body")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if plain != "hello!" {
+		t.Errorf("expecting %s, got %s", "hello!", plain)
+	}
+
+	/* Sealed for somewhere else */
+	if _, err = kr.OpenString(sealed, keyID, "other:text_body"); err == nil {
+		t.Errorf("expecting err opening with the wrong aad")
+	}
+
+	/* Blanks and a nil keyring stay in the clear */
+	if sealed, keyID, _ = kr.SealString("", "x"); sealed != "" || keyID != "" {
+		t.Errorf("expecting blank to stay blank, got %s under %s", sealed, keyID)
+	}
+	var none *Keyring
+	if sealed, keyID, _ = none.SealString("hi", "x"); sealed != "hi" || keyID != "" {
+		t.Errorf("expecting nil keyring to leave data be, got %s under %s", sealed, keyID)
+	}
+	if _, err = none.OpenString("abcd", "k1", "x"); err == nil {
+		t.Errorf("expecting err opening sealed data without a keyring")
+	}
+}
@@ -0,0 +1,412 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+/* How many send times the overview's calendar will look through, and
+ * how much mail a missive's page will list */
+const dashboardScan = 5000
+
+/* Dashboard is a small HTML admin for people who'd rather not hit the
+ * API (or the database) by hand. It's behind HTTP basic auth, since a
+ * browser can't sign requests, and its forms carry a token derived
+ * from the secret so another site can't submit them for you. */
+type Dashboard struct {
+	ds Datastore
+	waker *Waker
+	user string
+	password string
+	csrf string
+	pages map[string]*template.Template
+}
+
+func DashboardNew(ds Datastore, user string, password string, secret string, waker *Waker) (*Dashboard, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("dashboard:" + user + ":" + password))
+
+	d := &Dashboard{
+		ds: ds,
+		waker: waker,
+		user: user,
+		password: password,
+		csrf: hex.EncodeToString(mac.Sum(nil)),
+		pages: make(map[string]*template.Template),
+	}
+
+	funcs := template.FuncMap{
+		"when": func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.Local().Format("Mon 2 Jan 15:04")
+		},
+		"ago": func(t time.Time) string {
+			return time.Since(t).Round(time.Second).String()
+		},
+		"sendAt": func(m *Mail) time.Time {
+			return time.Time(m.SendAt)
+		},
+		"csrf": func() string {
+			return d.csrf
+		},
+		/* A button that posts to /admin/action */
+		"action": func(op string, target string, key string, back string) map[string]string {
+			return map[string]string{ "Op": op, "Target": target, "Key": key, "Back": back }
+		},
+		"dict": func(pairs ...interface{}) map[string]interface{} {
+			dict := make(map[string]interface{})
+			for i := 0; i + 1 < len(pairs); i += 2 {
+				dict[fmt.Sprint(pairs[i])] = pairs[i + 1]
+			}
+			return dict
+		},
+	}
+	for _, page := range []string{"index", "mails", "mail"} {
+		tmpl, err := template.New(page).Funcs(funcs).ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/" + page + ".html")
+		if err != nil {
+			return nil, err
+		}
+		d.pages[page] = tmpl
+	}
+	return d, nil
+}
+
+/* Mount the dashboard under /admin */
+func (d *Dashboard) Routes(r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(d.auth)
+
+	admin.HandleFunc("", d.overview).Methods("GET")
+	admin.HandleFunc("/", d.overview).Methods("GET")
+	admin.HandleFunc("/job/{job_key}", d.job).Methods("GET")
+	admin.HandleFunc("/missive/{missive}", d.missive).Methods("GET")
+	admin.HandleFunc("/mail/{idem_key}", d.mail).Methods("GET")
+	admin.HandleFunc("/action", d.action).Methods("POST")
+	admin.HandleFunc("/style.css", d.style).Methods("GET")
+}
+
+func (d *Dashboard) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(d.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) != 1 {
+			authFailures.Inc(routeName(r))
+			w.Header().Set("WWW-Authenticate", `Basic realm="mailer", charset="UTF-8"`)
+			http.Error(w, "Not auth'd", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *Dashboard) style(w http.ResponseWriter, r *http.Request) {
+	css, _ := dashboardFiles.ReadFile("dashboard/style.css")
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Write(css)
+}
+
+func (d *Dashboard) render(w http.ResponseWriter, page string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := d.pages[page].ExecuteTemplate(w, "layout", data); err != nil {
+		slog.Error("Unable to render dashboard", "page", page, "err", err)
+	}
+}
+
+func (d *Dashboard) fail(w http.ResponseWriter, err error) {
+	slog.Error("Dashboard error", "err", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+/* Page through FindMails for up to max mails. Says if there were more */
+func findAll(ds Datastore, filter *MailFilter, max int) ([]*Mail, bool, error) {
+	var all []*Mail
+	after := ""
+	for len(all) < max {
+		mails, err := ds.FindMails(filter, after, 100)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(mails) == 0 {
+			return all, false, nil
+		}
+		all = append(all, mails...)
+		after = mails[len(mails) - 1].IdemKey()
+	}
+	return all[:max], true, nil
+}
+
+/* How far along a job or missive is */
+type progress struct {
+	Key string
+	Total int
+	Counts map[string]int
+}
+
+func (p *progress) Done() int {
+	return p.Counts[string(SENT)] * 100 / p.Total
+}
+
+func tally(byKey map[string]*progress, key string, state ScheduleState, count int64) {
+	p, ok := byKey[key]
+	if !ok {
+		p = &progress{ Key: key, Counts: make(map[string]int) }
+		byKey[key] = p
+	}
+	p.Total += int(count)
+	p.Counts[string(state)] += int(count)
+}
+
+func sorted(byKey map[string]*progress) []*progress {
+	list := make([]*progress, 0, len(byKey))
+	for _, p := range byKey {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+type calendarDay struct {
+	Day time.Time
+	Count int
+	Jobs []*progress
+}
+
+func (d *Dashboard) overview(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	stats, err := d.ds.QueueStats(now)
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+
+	byState := make(map[ScheduleState]int64)
+	for _, c := range stats.Counts {
+		byState[c.State] += c.Count
+	}
+
+	counts, err := d.ds.CountByJob()
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+	jobs := make(map[string]*progress)
+	missives := make(map[string]*progress)
+	for _, c := range counts {
+		tally(jobs, c.JobKey, c.State, c.Count)
+		if c.Missive.Valid {
+			tally(missives, c.Missive.String, c.State, c.Count)
+		}
+	}
+
+	/* What's waiting to go out, by day; anything overdue goes today */
+	horizon := now.AddDate(0, 0, 14)
+	waiting, err := d.ds.CountWaiting(horizon, dashboardScan)
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+	truncated := len(waiting) == dashboardScan
+	days := make(map[string]*calendarDay)
+	dayJobs := make(map[string]map[string]*progress)
+	for _, c := range waiting {
+		sendAt := time.Unix(c.SendAt, 0).Local()
+		if sendAt.Before(now) {
+			sendAt = now
+		}
+		key := sendAt.Format("2006-01-02")
+		if _, ok := days[key]; !ok {
+			y, mo, dd := sendAt.Date()
+			days[key] = &calendarDay{ Day: time.Date(y, mo, dd, 0, 0, 0, 0, time.Local) }
+			dayJobs[key] = make(map[string]*progress)
+		}
+		days[key].Count += int(c.Count)
+		tally(dayJobs[key], c.JobKey, UNSENT, c.Count)
+	}
+
+	calendar := make([]*calendarDay, 0, len(days))
+	for key, day := range days {
+		day.Jobs = sorted(dayJobs[key])
+		calendar = append(calendar, day)
+	}
+	sort.Slice(calendar, func(i, j int) bool { return calendar[i].Day.Before(calendar[j].Day) })
+
+	/* Soonest to be retried first */
+	failures, err := d.ds.FailingMails(50)
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+
+	paused, err := d.ds.IsPaused()
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+
+	d.render(w, "index", map[string]interface{}{
+		"Title": "Overview",
+		"Msg": r.URL.Query().Get("msg"),
+		"Paused": paused,
+		"Stats": stats,
+		"States": []ScheduleState{ UNSENT, INPROG, FAILED, PAUSED, SENT, EXPIRED },
+		"ByState": byState,
+		"Calendar": calendar,
+		"Failures": failures,
+		"Jobs": sorted(jobs),
+		"Missives": sorted(missives),
+		"Truncated": truncated,
+		"Scan": dashboardScan,
+	})
+}
+
+func (d *Dashboard) mailList(w http.ResponseWriter, r *http.Request, target string, key string, mails []*Mail) {
+	sort.Slice(mails, func(i, j int) bool {
+		return time.Time(mails[i].SendAt).Before(time.Time(mails[j].SendAt))
+	})
+	d.render(w, "mails", map[string]interface{}{
+		"Title": target + " " + key,
+		"Msg": r.URL.Query().Get("msg"),
+		"Target": target,
+		"Key": key,
+		"Mails": mails,
+		"Back": r.URL.Path,
+	})
+}
+
+func (d *Dashboard) job(w http.ResponseWriter, r *http.Request) {
+	jobKey := mux.Vars(r)["job_key"]
+	mails, err := d.ds.GetJob(jobKey)
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+	d.mailList(w, r, "job", jobKey, mails)
+}
+
+func (d *Dashboard) missive(w http.ResponseWriter, r *http.Request) {
+	missive := mux.Vars(r)["missive"]
+	mails, _, err := findAll(d.ds, &MailFilter{ Missive: missive }, dashboardScan)
+	if err != nil {
+		d.fail(w, err)
+		return
+	}
+	d.mailList(w, r, "missive", missive, mails)
+}
+
+func (d *Dashboard) mail(w http.ResponseWriter, r *http.Request) {
+	m, err := d.ds.GetMail(mux.Vars(r)["idem_key"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	d.render(w, "mail", map[string]interface{}{
+		"Title": m.Title,
+		"Msg": r.URL.Query().Get("msg"),
+		"Mail": m,
+		"Back": r.URL.Path,
+	})
+}
+
+/* Every button on the dashboard posts here: op is one of pause,
+ * resume, retry or cancel, and applies to the job, missive or mail
+ * named by target and key */
+func (d *Dashboard) action(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(d.csrf)) != 1 {
+		http.Error(w, "Bad form token", http.StatusForbidden)
+		return
+	}
+
+	op, target, key := r.FormValue("op"), r.FormValue("target"), r.FormValue("key")
+	count, err := d.apply(op, target, key)
+	msg := fmt.Sprintf("%s %s %s: %d mails", op, target, key, count)
+	if err != nil {
+		slog.Error("Dashboard action failed", "op", op, "target", target, "key", key, "err", err)
+		msg = fmt.Sprintf("%s %s %s failed: %s", op, target, key, err)
+	} else {
+		slog.Info("Dashboard action", "op", op, "target", target, "key", key, "count", count)
+		audit(d.ds, r, "dashboard:" + d.user, op, string(dashboardTargets[target]), key, count)
+	}
+	if op == "resume" || op == "retry" {
+		d.waker.Wake()
+	}
+
+	/* Back where they came from, unless that's somewhere else entirely */
+	back := r.FormValue("back")
+	if !strings.HasPrefix(back, "/admin") || (op == "cancel" && target == "mail") {
+		back = "/admin"
+	}
+	http.Redirect(w, r, back + "?msg=" + url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+/* What the dashboard's targets are called everywhere else */
+var dashboardTargets = map[string]PauseTarget{
+	"job": PauseJob,
+	"missive": PauseMissive,
+	"mail": PauseMail,
+}
+
+func (d *Dashboard) apply(op string, target string, key string) (int64, error) {
+	pt, ok := dashboardTargets[target]
+	if !ok || key == "" {
+		return 0, fmt.Errorf("Unknown target %q", target)
+	}
+
+	switch op {
+	case "pause":
+		return d.ds.Pause(pt, key)
+	case "resume":
+		return d.ds.Resume(pt, key)
+	case "cancel":
+		switch target {
+		case "job":
+			return d.ds.DeleteJob(key)
+		case "missive":
+			return d.ds.CancelMissive(key)
+		}
+		return d.ds.CancelMail(key)
+	case "retry":
+		if target == "mail" {
+			return d.ds.RetryMail(key, time.Now())
+		}
+		filter := &MailFilter{ JobKey: key }
+		if target == "missive" {
+			filter = &MailFilter{ Missive: key }
+		}
+		var count int64
+		for _, state := range []ScheduleState{ FAILED, EXPIRED } {
+			filter.State = state
+			mails, _, err := findAll(d.ds, filter, dashboardScan)
+			if err != nil {
+				return count, err
+			}
+			for _, m := range mails {
+				n, err := d.ds.RetryMail(m.IdemKey(), time.Now())
+				if err != nil {
+					return count, err
+				}
+				count += n
+			}
+		}
+		return count, nil
+	}
+	return 0, fmt.Errorf("Unknown operation %q", op)
+}
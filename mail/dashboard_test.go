@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	tt "testing"
+	"time"
+)
+
+func TestDashboard(t *tt.T) {
+	ds := MemStoreNew()
+	now := time.Now()
+	m := &Mail{
+		JobKey: "course-42",
+		Missive: sql.NullString{ String: "week-1", Valid: true },
+		ToAddr: "hi@example.com",
+		Title: "Week 1",
+		HTMLBody: `<p>Hello "there"</p><script>alert(1)</script>`,
+		TextBody: "hello",
+		SendAt: Timestamp(now.Add(time.Hour)),
+	}
+	failing := &Mail{
+		JobKey: "course-42",
+		ToAddr: "bounce@example.com",
+		Title: "Week 0",
+		TextBody: "hello",
+		SendAt: Timestamp(now.Add(-time.Hour)),
+	}
+	ds.ScheduleMail(m)
+	ds.ScheduleMail(failing)
+	ds.RescheduleFailed(failing.IdemKey(), 3, now.Add(time.Hour).Unix(), "mailbox unavailable")
+
+	dash, err := DashboardNew(ds, "admin", "hunter2", "secret", NewWaker())
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	routes := SetupRoutes(ds, "secret", "", nil, NewWaker(), NewWorkerHealth(time.Minute), dash)
+
+	get := func(path string, auth bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if auth {
+			r.SetBasicAuth("admin", "hunter2")
+		}
+		routes.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/admin", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("expecting %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w := get("/admin", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expecting %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	for _, want := range []string{"course-42", "week-1", "mailbox unavailable", "Week 0"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expecting %s on the overview", want)
+		}
+	}
+
+	/* The preview's body is sandboxed and escaped into the iframe */
+	w = get("/admin/mail/" + m.IdemKey(), true)
+	if !strings.Contains(w.Body.String(), `sandbox srcdoc="&lt;p&gt;Hello &#34;there&#34;&lt;/p&gt;`) {
+		t.Errorf("expecting an escaped, sandboxed preview, got %s", w.Body.String())
+	}
+
+	if w = get("/admin/job/course-42", true); !strings.Contains(w.Body.String(), "bounce@example.com") {
+		t.Errorf("expecting the job's mail to be listed")
+	}
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/admin/action", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("admin", "hunter2")
+		routes.ServeHTTP(w, r)
+		return w
+	}
+
+	/* Not without the form token */
+	form := url.Values{ "op": {"pause"}, "target": {"job"}, "key": {"course-42"}, "back": {"/admin/job/course-42"} }
+	if w = post(form); w.Code != http.StatusForbidden {
+		t.Errorf("expecting %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	form.Set("csrf", dash.csrf)
+	w = post(form)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/admin/job/course-42?msg=") {
+		t.Errorf("expecting a redirect back to the job, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	checkMailState(t, ds, PAUSED, 2)
+
+	form.Set("op", "resume")
+	post(form)
+	form = url.Values{ "csrf": {dash.csrf}, "op": {"retry"}, "target": {"mail"}, "key": {failing.IdemKey()}, "back": {"https://example.com"} }
+	if w = post(form); !strings.HasPrefix(w.Header().Get("Location"), "/admin?") {
+		t.Errorf("expecting a redirect to the overview, got %s", w.Header().Get("Location"))
+	}
+	checkMailState(t, ds, UNSENT, 2)
+
+	entries, _ := ds.FindAudit(&AuditFilter{ Client: "dashboard:admin" }, 0, 10)
+	if len(entries) != 3 || entries[0].Action != "retry" || entries[0].Target != "idem_key" {
+		t.Errorf("expecting the dashboard's changes to be audited, got %v", entries)
+	}
+}
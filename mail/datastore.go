@@ -1,45 +1,89 @@
 package mail
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/jmoiron/sqlx"
 )
 
-var db *sqlx.DB
+/* Where scheduled mail lives. SQLiteStore is the real thing;
+ * MemStore keeps everything in memory, for tests and dev mode. */
+type Datastore interface {
+	ScheduleMail(m *Mail) error
+	GetMail(idemKey string) (*Mail, error)
+	GetJob(jobKey string) ([]*Mail, error)
+	ListJobs(state *ScheduleState) ([]*Mail, error)
+	FindMails(filter *MailFilter, after string, limit int) ([]*Mail, error)
+	ImportMail(m *Mail) error
+	SetState(idemKey string, state ScheduleState) error
 
-var db_setup_exec = []string{
-	"CREATE TABLE db_metadata (key TEXT NOT NULL PRIMARY KEY, value TEXT);",
-	"INSERT INTO db_metadata (key, value) values ('migrations', -1);",
-}
+	GetToSendBatch(when time.Time, batchSize int, workerID string, lease time.Duration) ([]*Mail, error)
+	ExtendLease(workerID string, until time.Time) error
+	ReleaseClaims(workerID string, keep ...string) (int64, error)
+	ResetInProgress() error
+	NextSendAt() (next time.Time, ok bool, err error)
+	QueueStats(when time.Time) (*QueueStats, error)
+	CountByJob() ([]*MailCount, error)
+	CountWaiting(until time.Time, limit int) ([]*MailCount, error)
+	FailingMails(limit int) ([]*Mail, error)
+	SchemaVersion() (int, error)
+	ExpireStale(when time.Time) (int64, error)
+
+	MarkSent(idemKey string, providerID string) error
+	MarkExpired(idemKey string) error
+	RescheduleFailed(idemKey string, tryCount int, sendAt int64, lastErr string) error
+	RetryMail(idemKey string, when time.Time) (int64, error)
+
+	DeleteJob(jobKey string) (int64, error)
+	DeleteSubscription(subKey string) (int64, error)
+	CancelMissive(missive string) (int64, error)
+	CancelJob(jobKey string) (int64, error)
+	CancelMail(idemKey string) (int64, error)
+
+	Pause(target PauseTarget, key string) (int64, error)
+	Resume(target PauseTarget, key string) (int64, error)
+	SetPaused(paused bool) error
+	IsPaused() (bool, error)
+
+	EditMail(idemKey string, edit *MailEdit) (int64, error)
+	EditMissive(missive string, edit *MailEdit) (int64, error)
+
+	PutAttachment(a *Attachment) (string, error)
+	GetAttachments(hashes []string) (AttachSet, error)
+	CollectAttachments(grace time.Duration) (int64, error)
 
-var db_migration_exec = []string{
-	`CREATE TABLE scheduled 
-		(	
-			idem_key TEXT NOT NULL PRIMARY KEY,
-			job_key TEXT NOT NULL,
-			to_addr TEXT NOT NULL,
-			to_name TEXT,
-			from_addr TEXT,
-			from_name TEXT,
-			reply_to TEXT,
-			title TEXT NOT NULL,
-			html_body TEXT NOT NULL,
-			text_body TEXT NOT NULL,
-			attachments BLOB,
-			send_at BIGINT NOT NULL,
-			state TEXT NOT NULL DEFAULT 'unsent',
-			try_count INT NOT NULL DEFAULT 0
-	        );`,
-	`ALTER TABLE scheduled ADD COLUMN mail_domain TEXT;`,
-	`ALTER TABLE scheduled ADD COLUMN sub TEXT;`,
-	`ALTER TABLE scheduled ADD COLUMN missive TEXT;`,
+	RecordAudit(entry *AuditEntry) error
+	FindAudit(filter *AuditFilter, before int64, limit int) ([]*AuditEntry, error)
+
+	PurgeFinished(stripBefore time.Time, deleteBefore time.Time) (stripped int64, deleted int64, err error)
+	Vacuum() error
+	Reencrypt(batchSize int) (int64, error)
 }
 
-func (ds *Datastore) CurrMigrations() int {
-	return len(db_migration_exec)
+/* What ScheduleMail and ImportMail return (wrapped) when there's
+ * already a mail with that idem key */
+var ErrAlreadyScheduled = errors.New("already scheduled")
+
+/* Everything that gets scanned into a Mail */
+const mailColumns = `idem_key, job_key, sub, missive, to_addr, to_name, from_addr, from_name, reply_to, title, html_body, text_body, send_at, state, try_count, mail_domain, priority, expires_at, revision, provider_id, last_error`
+
+/* A mail without its bodies or attachments, for listings */
+const headerColumns = `idem_key, job_key, sub, missive, to_addr, to_name, from_addr, from_name, reply_to, title, send_at, state, try_count, mail_domain, priority, expires_at, revision, provider_id, last_error`
+
+/* A mail as it's stored, bodies sealed with key_id (if set). The last
+ * error is sealed apart, with error_key_id, as it changes on its own */
+const storedColumns = mailColumns + `, key_id, error_key_id`
+type storedMail struct {
+	Mail
+	KeyID sql.NullString `db:"key_id"`
+	ErrorKeyID sql.NullString `db:"error_key_id"`
 }
 
 type ScheduleState string
@@ -48,205 +92,532 @@ const (
 	INPROG ScheduleState = "inprog"
 	FAILED ScheduleState = "failed"
 	SENT ScheduleState = "sent"
+	EXPIRED ScheduleState = "expired"
+	PAUSED ScheduleState = "paused"
 )
 
-func setupTables() error {
-	stmt := `SELECT count(*) FROM sqlite_master WHERE type='table' AND name='db_metadata';`
-	var count int
-	err := db.Get(&count, stmt)
-	if err != nil {
-		return err
-	}
+func (ds *SQLiteStore) SetState(idemKey string, state ScheduleState) error {
+	stmt := `UPDATE scheduled SET state = ? WHERE idem_key = ?`
+	_, err := ds.Data.Exec(stmt, state, idemKey)
+	return err
+}
 
-	if count > 0 {
-		return nil
-	}
+func (ds *SQLiteStore) ListJobs(state *ScheduleState) ([]*Mail, error) {
+	stmt := `SELECT ` + storedColumns + ` FROM scheduled WHERE state = ?`
+	return ds.selectMails(stmt, state)
+}
 
-	for _, quer := range db_setup_exec {
-		db.MustExec(quer)
-	}
+/* Page through the mails matching filter, by idem key: pass the last
+ * key of one page as after to get the next */
+func (ds *SQLiteStore) FindMails(filter *MailFilter, after string, limit int) ([]*Mail, error) {
+	where := []string{"idem_key > ?"}
+	args := []interface{}{after}
 
-	return nil
-}
+	if filter.State != "" {
+		where = append(where, "state = ?")
+		args = append(args, filter.State)
+	}
+	if filter.JobKey != "" {
+		where = append(where, "job_key = ?")
+		args = append(args, filter.JobKey)
+	}
+	if filter.Missive != "" {
+		where = append(where, "missive = ?")
+		args = append(args, filter.Missive)
+	}
+	if !filter.SendFrom.IsZero() {
+		where = append(where, "send_at >= ?")
+		args = append(args, filter.SendFrom.UTC().Unix())
+	}
+	if !filter.SendTo.IsZero() {
+		where = append(where, "send_at < ?")
+		args = append(args, filter.SendTo.UTC().Unix())
+	}
 
-func (ds *Datastore) CountMigrations() int {
-	return len(db_migration_exec)
+	stmt := `SELECT ` + storedColumns + ` FROM scheduled
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY idem_key
+		LIMIT ?`
+	return ds.selectMails(stmt, append(args, limit)...)
 }
 
-func currentMigration() (int, error) {
-	var migration int
-	keyLookup := `SELECT value FROM db_metadata WHERE key = 'migrations';`
-
-	err := db.Get(&migration, keyLookup)
+/* Run a query for mails, opening their bodies and loading attachments */
+func (ds *SQLiteStore) selectMails(stmt string, args ...interface{}) ([]*Mail, error) {
+	var stored []*storedMail
+	err := ds.Data.Select(&stored, stmt, args...)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	mails := make([]*Mail, len(stored))
+	for i, s := range stored {
+		s.HTMLBody, s.TextBody, err = ds.openBodies(s.Idem, s.HTMLBody, s.TextBody, s.KeyID.String)
+		if err == nil {
+			err = ds.openLastError(s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open mail %s: %s", s.Idem, err)
+		}
+		mails[i] = &s.Mail
 	}
+	return mails, ds.loadAttachments(mails)
+}
+
+/* Provider errors can quote the recipient back, so they're sealed
+ * like the bodies are */
+func (ds *SQLiteStore) openLastError(s *storedMail) error {
+	var err error
+	s.LastError.String, err = ds.Keys.OpenString(s.LastError.String, s.ErrorKeyID.String, bodyAAD(s.Idem, "last_error"))
+	return err
+}
 
-	return migration, nil
+/* Bodies are sealed against the mail they belong to, so they can't
+ * be moved between rows */
+func bodyAAD(idemKey string, col string) string {
+	return idemKey + ":" + col
 }
 
-func initDatabase(dBConn string) (err error) {
-	db, err = sqlx.Open("sqlite3", dBConn)
+func (ds *SQLiteStore) sealBodies(idemKey string, html string, text string) (string, string, sql.NullString, error) {
+	sealedHTML, htmlKey, err := ds.Keys.SealString(html, bodyAAD(idemKey, "html_body"))
 	if err != nil {
-		return err
+		return "", "", sql.NullString{}, err
 	}
-
-	db.SetMaxIdleConns(8)
-	db.SetMaxOpenConns(8)
-	err = setupTables()
+	sealedText, textKey, err := ds.Keys.SealString(text, bodyAAD(idemKey, "text_body"))
 	if err != nil {
-		return err
+		return "", "", sql.NullString{}, err
 	}
 
-	curr_migrate, err := currentMigration()
-	if err != nil {
-		return err
+	/* Either can be blank, and so left in the clear */
+	keyID := htmlKey
+	if keyID == "" {
+		keyID = textKey
 	}
+	return sealedHTML, sealedText, sql.NullString{ String: keyID, Valid: keyID != "" }, nil
+}
 
-	fmt.Println("current migration:", curr_migrate)
-	migrate_to := len(db_migration_exec) - 1
-	if curr_migrate > migrate_to {
-		return fmt.Errorf("Saved migration %d > proposed list %d\n", curr_migrate, migrate_to)
+func (ds *SQLiteStore) openBodies(idemKey string, html string, text string, keyID string) (string, string, error) {
+	html, err := ds.Keys.OpenString(html, keyID, bodyAAD(idemKey, "html_body"))
+	if err != nil {
+		return "", "", err
 	}
+	text, err = ds.Keys.OpenString(text, keyID, bodyAAD(idemKey, "text_body"))
+	return html, text, err
+}
 
-	/* Start a transaction */
-	tx := db.MustBegin()
-	for i, migration := range db_migration_exec {
-		if i <= curr_migrate {
-			continue
-		}
+/* Claim a batch of due mails for workerID. Claimed rows are 'inprog'
+ * until the lease runs out; once it has, any worker may claim them again
+ * (counting the lost attempt as a try).
+ *
+ * Higher priority mail goes first. Within a priority we take turns
+ * between job keys, so one big job can't crowd everyone else out of
+ * the batch. Ties go by job key, then idem key, so the order is the
+ * same every time (and the same as MemStore's). */
+func (ds *SQLiteStore) GetToSendBatch(when time.Time, batchSize int, workerID string, lease time.Duration) ([]*Mail, error) {
+	now := when.UTC().Unix()
+	claim := `UPDATE scheduled
+		SET
+			state = 'inprog',
+			claimed_by = ?,
+			lease_expires_at = ?,
+			try_count = try_count + (CASE WHEN state = 'inprog' THEN 1 ELSE 0 END)
+		WHERE idem_key IN (
+			SELECT idem_key FROM (
+				SELECT idem_key, job_key, priority, send_at,
+					ROW_NUMBER() OVER (PARTITION BY priority, job_key ORDER BY send_at, idem_key) AS turn
+				FROM scheduled
+				WHERE
+					   ((state = 'failed' AND try_count < 20)
+					OR state = 'unsent'
+					OR (state = 'inprog' AND try_count < 20
+						AND (lease_expires_at IS NULL OR lease_expires_at <= ?)))
+					AND send_at <= ?
+					AND (expires_at IS NULL OR expires_at > ?)
+			)
+			ORDER BY priority DESC, turn, send_at, job_key, idem_key
+			LIMIT ?)`
 
-		fmt.Println("executing migration:", migration)
-		/* execute the migration */
-		tx.MustExec(migration)
+	_, err := ds.Data.Exec(claim, workerID, when.Add(lease).UTC().Unix(), now, now, now, batchSize)
+	if err != nil {
+		return nil, err
 	}
 
-	/* Save the migration index to the database */
-	tx.MustExec(`UPDATE db_metadata SET value = ? WHERE key = 'migrations';`, migrate_to)
-
-	/* Commit the updates */
-	err = tx.Commit()
+	stmt := `SELECT ` + storedColumns + `
+		FROM scheduled
+		WHERE state = 'inprog' AND claimed_by = ?
+		ORDER BY
+			priority DESC,
+			ROW_NUMBER() OVER (PARTITION BY priority, job_key ORDER BY send_at, idem_key),
+			send_at,
+			job_key,
+			idem_key`
+	return ds.selectMails(stmt, workerID)
+}
 
-	if err == nil && curr_migrate != migrate_to {
-		fmt.Printf("Rolled database forward from %d to %d\n", curr_migrate, migrate_to)
+/* Move anything that would be up for sending, but whose deadline has
+ * passed by when, to 'expired' */
+func (ds *SQLiteStore) ExpireStale(when time.Time) (int64, error) {
+	now := when.UTC().Unix()
+	stmt := `UPDATE scheduled
+		SET
+			state = 'expired',
+			claimed_by = NULL,
+			lease_expires_at = NULL,
+			finished_at = ?
+		WHERE expires_at <= ?
+			AND (state = 'unsent' OR state = 'failed'
+				OR (state = 'inprog' AND (lease_expires_at IS NULL OR lease_expires_at <= ?)))`
+	res, err := ds.Data.Exec(stmt, time.Now().UTC().Unix(), now, now)
+	if err != nil {
+		return 0, err
 	}
-
-	return err
+	return res.RowsAffected()
 }
 
-func (ds *Datastore) SetState(idemKey string, state ScheduleState) error {
-	stmt := `UPDATE scheduled SET state = ? WHERE idem_key = ?`
-	_, err := ds.Data.Exec(stmt, state, idemKey)
+/* Push out the lease on everything workerID still has claimed */
+func (ds *SQLiteStore) ExtendLease(workerID string, until time.Time) error {
+	stmt := `UPDATE scheduled SET lease_expires_at = ? WHERE state = 'inprog' AND claimed_by = ?`
+	_, err := ds.Data.Exec(stmt, until.UTC().Unix(), workerID)
 	return err
 }
 
-func (ds *Datastore) ListJobs(state *ScheduleState) ([]*Mail, error) {
-	stmt := `SELECT job_key, sub, missive, to_addr, to_name, from_addr, from_name, reply_to, title, html_body, text_body, attachments, send_at, state, try_count, mail_domain from scheduled WHERE state = ?`
-
-	var mail []*Mail
-	err := ds.Data.Select(&mail, stmt, state)
-	return mail, err
+/* Hand back any claims workerID hasn't gotten to yet, eg on shutdown.
+ * Mails that were never tried go back to 'unsent', the rest to 'failed'.
+ * Claims in keep stay put until their lease runs out */
+func (ds *SQLiteStore) ReleaseClaims(workerID string, keep ...string) (int64, error) {
+	stmt := `UPDATE scheduled
+		SET
+			state = (CASE WHEN try_count > 0 THEN 'failed' ELSE 'unsent' END),
+			claimed_by = NULL,
+			lease_expires_at = NULL
+		WHERE state = 'inprog' AND claimed_by = ?`
+	args := []interface{}{ workerID }
+	if len(keep) > 0 {
+		query, inArgs, err := sqlx.In(stmt + ` AND idem_key NOT IN (?)`, workerID, keep)
+		if err != nil {
+			return 0, err
+		}
+		stmt, args = query, inArgs
+	}
+	res, err := ds.Data.Exec(stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (ds *Datastore) GetToSendBatch(when time.Time, batchSize int) ([]*Mail, error) {
-	stmt := `SELECT job_key, sub, missive, to_addr, to_name, from_addr, from_name, reply_to, title, html_body, text_body, attachments, send_at, state, try_count, mail_domain
-		FROM scheduled 
-		WHERE 
-			   ((state = 'failed' AND try_count < 20) 
-			OR state = 'unsent')
-			AND send_at <= ?
-		ORDER BY send_at
-		LIMIT ?`
+/* When the next mail comes due, including claims whose lease runs out.
+ * ok is false if there's nothing left to send at all. */
+func (ds *SQLiteStore) NextSendAt() (next time.Time, ok bool, err error) {
+	stmt := `SELECT MIN(t) FROM (
+			SELECT MIN(send_at) AS t FROM scheduled
+			WHERE (state = 'failed' AND try_count < 20) OR state = 'unsent'
+			UNION ALL
+			SELECT MIN(lease_expires_at) AS t FROM scheduled
+			WHERE state = 'inprog' AND try_count < 20
+		)`
 
-	var mail []*Mail
-	err := ds.Data.Select(&mail, stmt, when.UTC().Unix(), batchSize)
-	if err != nil {
-		return nil, err
+	var at sql.NullInt64
+	if err = ds.Data.Get(&at, stmt); err != nil {
+		return next, false, err
+	}
+	if !at.Valid {
+		return next, false, nil
 	}
+	return time.Unix(at.Int64, 0), true, nil
+}
 
-	if len(mail) == 0 {
-		return mail, nil
+/* Mail by state and domain, and what's due by when but not yet gone
+ * out. A mail under a live claim is on its way, so isn't counted as
+ * waiting. */
+func (ds *SQLiteStore) QueueStats(when time.Time) (*QueueStats, error) {
+	stats := &QueueStats{}
+	stmt := `SELECT state, COALESCE(mail_domain, '') AS mail_domain, count(*) AS count
+		FROM scheduled
+		GROUP BY state, COALESCE(mail_domain, '')
+		ORDER BY state, mail_domain`
+	if err := ds.Data.Select(&stats.Counts, stmt); err != nil {
+		return nil, err
 	}
 
-	/* Update all of these guys to be 'inprog' */
-	keys := make([]string, len(mail))
-	for i, m := range mail {
-		keys[i] = m.IdemKey()
+	now := when.UTC().Unix()
+	var due struct {
+		Count int64 `db:"count"`
+		Oldest sql.NullInt64 `db:"oldest"`
 	}
-	update := `UPDATE scheduled SET state = 'inprog' WHERE idem_key IN (?);`
-	exec, args, err := sqlx.In(update, keys)
-	if err != nil {
+	stmt = `SELECT count(*) AS count, MIN(send_at) AS oldest
+		FROM scheduled
+		WHERE
+			   (state = 'unsent'
+			OR (state = 'failed' AND try_count < 20)
+			OR (state = 'inprog' AND try_count < 20
+				AND (lease_expires_at IS NULL OR lease_expires_at <= ?)))
+			AND send_at <= ?
+			AND (expires_at IS NULL OR expires_at > ?)`
+	if err := ds.Data.Get(&due, stmt, now, now, now); err != nil {
 		return nil, err
 	}
-	if _, err = ds.Data.Exec(exec, args...); err != nil {
+
+	stats.Due = due.Count
+	if due.Oldest.Valid {
+		stats.OldestDue = time.Unix(due.Oldest.Int64, 0)
+	}
+	return stats, nil
+}
+
+/* How many mails each job and missive has in each state */
+func (ds *SQLiteStore) CountByJob() ([]*MailCount, error) {
+	var counts []*MailCount
+	stmt := `SELECT job_key, missive, state, count(*) AS count
+		FROM scheduled
+		GROUP BY job_key, missive, state
+		ORDER BY job_key, missive, state`
+	return counts, ds.Data.Select(&counts, stmt)
+}
+
+/* How many mails each job has waiting to go out (or go out again)
+ * at each send time before until, soonest first */
+func (ds *SQLiteStore) CountWaiting(until time.Time, limit int) ([]*MailCount, error) {
+	var counts []*MailCount
+	stmt := `SELECT job_key, send_at, count(*) AS count
+		FROM scheduled
+		WHERE state IN ('unsent', 'failed', 'inprog')
+			AND send_at < ?
+		GROUP BY job_key, send_at
+		ORDER BY send_at, job_key
+		LIMIT ?`
+	return counts, ds.Data.Select(&counts, stmt, until.UTC().Unix(), limit)
+}
+
+/* Failed mail, next to be retried first, without bodies or attachments */
+func (ds *SQLiteStore) FailingMails(limit int) ([]*Mail, error) {
+	var stored []*storedMail
+	stmt := `SELECT ` + headerColumns + `, error_key_id FROM scheduled
+		WHERE state = 'failed'
+		ORDER BY send_at, idem_key
+		LIMIT ?`
+	if err := ds.Data.Select(&stored, stmt, limit); err != nil {
 		return nil, err
 	}
 
-	return mail, err
+	mails := make([]*Mail, len(stored))
+	for i, s := range stored {
+		if err := ds.openLastError(s); err != nil {
+			return nil, fmt.Errorf("Unable to open mail %s: %s", s.Idem, err)
+		}
+		mails[i] = &s.Mail
+	}
+	return mails, nil
 }
 
-func (ds *Datastore) GetJob(jobKey string) ([]*Mail, error) {
-	stmt := `SELECT job_key, sub, missive, to_addr, to_name, from_addr, from_name, reply_to, title, html_body, text_body, attachments, send_at, state, try_count, mail_domain FROM scheduled WHERE job_key = ?`
+/* The latest migration applied */
+func (ds *SQLiteStore) SchemaVersion() (int, error) {
+	return schemaVersion(ds.Data)
+}
 
-	var mail []*Mail
-	err := ds.Data.Select(&mail, stmt, jobKey)
-	return mail, err
+func (ds *SQLiteStore) GetJob(jobKey string) ([]*Mail, error) {
+	stmt := `SELECT ` + storedColumns + ` FROM scheduled WHERE job_key = ?`
+	return ds.selectMails(stmt, jobKey)
 }
 
-func (ds *Datastore) DeleteJob(jobKey string) {
+func (ds *SQLiteStore) DeleteJob(jobKey string) (int64, error) {
 	stmt := `DELETE FROM scheduled 
 			WHERE job_key = ?
-			AND (state = 'unsent' OR state = 'failed')`
-	ds.Data.MustExec(stmt, jobKey)
+			AND (state = 'unsent' OR state = 'failed' OR state = 'paused')`
+	res, err := ds.Data.Exec(stmt, jobKey)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (ds *Datastore) DeleteSubscription(subKey string) {
+func (ds *SQLiteStore) DeleteSubscription(subKey string) (int64, error) {
 	stmt := `DELETE FROM scheduled
 			WHERE sub = ?
-			AND (state = 'unsent' OR state = 'failed')`
-	ds.Data.MustExec(stmt, subKey)
+			AND (state = 'unsent' OR state = 'failed' OR state = 'paused')`
+	res, err := ds.Data.Exec(stmt, subKey)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (ds *Datastore) CancelMissive(subKey string) {
+func (ds *SQLiteStore) CancelMissive(missive string) (int64, error) {
 	stmt := `DELETE FROM scheduled
 			WHERE missive = ?
 			AND state != 'sent'`
-	ds.Data.MustExec(stmt, subKey)
+	res, err := ds.Data.Exec(stmt, missive)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (ds *Datastore) CancelJob(jobKey string) {
+func (ds *SQLiteStore) CancelMail(idemKey string) (int64, error) {
+	stmt := `DELETE FROM scheduled WHERE idem_key = ? AND state != 'sent'`
+	res, err := ds.Data.Exec(stmt, idemKey)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (ds *SQLiteStore) CancelJob(jobKey string) (int64, error) {
 	stmt := `DELETE FROM scheduled WHERE job_key = ? AND state != 'sent'`
-	ds.Data.MustExec(stmt, jobKey)
+	res, err := ds.Data.Exec(stmt, jobKey)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
+/* Which column a pause/resume applies to */
+type PauseTarget string
+const (
+	PauseJob PauseTarget = "job_key"
+	PauseSubscription PauseTarget = "sub"
+	PauseMissive PauseTarget = "missive"
+	PauseMail PauseTarget = "idem_key"
+)
+
+/* Hold every unsent or failed mail for the target. Mails already claimed
+ * by a worker aren't touched: they're going out. */
+func (ds *SQLiteStore) Pause(target PauseTarget, key string) (int64, error) {
+	stmt := fmt.Sprintf(`UPDATE scheduled
+		SET state = 'paused'
+		WHERE %s = ?
+			AND (state = 'unsent' OR state = 'failed')`, target)
+	res, err := ds.Data.Exec(stmt, key)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+/* Put paused mails for the target back in line. Anything that
+ * had been tried before goes back to 'failed', the rest to 'unsent' */
+func (ds *SQLiteStore) Resume(target PauseTarget, key string) (int64, error) {
+	stmt := fmt.Sprintf(`UPDATE scheduled
+		SET state = (CASE WHEN try_count > 0 THEN 'failed' ELSE 'unsent' END)
+		WHERE %s = ?
+			AND state = 'paused'`, target)
+	res, err := ds.Data.Exec(stmt, key)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+/* The global kill switch. While set, workers don't claim any mail */
+func (ds *SQLiteStore) SetPaused(paused bool) error {
+	value := "0"
+	if paused {
+		value = "1"
+	}
+	stmt := `INSERT INTO db_metadata (key, value) VALUES ('paused', ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`
+	_, err := ds.Data.Exec(stmt, value)
+	return err
+}
+
+func (ds *SQLiteStore) IsPaused() (bool, error) {
+	stmt := `SELECT value FROM db_metadata WHERE key = 'paused'`
+	var value string
+	err := ds.Data.Get(&value, stmt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return value == "1", err
+}
+
+func (ds *SQLiteStore) RescheduleFailed(idemKey string, tryCount int, sendAt int64, lastErr string) error {
+	sealed, keyID, err := ds.Keys.SealString(lastErr, bodyAAD(idemKey, "last_error"))
+	if err != nil {
+		return err
+	}
 
-func (ds *Datastore) RescheduleFailed(idemKey string, tryCount int, sendAt int64) {
 	stmt := `UPDATE scheduled 
 		SET 
 			state = 'failed', 
 			try_count = ?,
-			send_at = ?
+			send_at = ?,
+			last_error = ?,
+			error_key_id = ?,
+			claimed_by = NULL,
+			lease_expires_at = NULL
 		WHERE idem_key = ?`
-	ds.Data.MustExec(stmt, tryCount, sendAt, idemKey)
+	_, err = ds.Data.Exec(stmt, tryCount, sendAt, sealed, sql.NullString{ String: keyID, Valid: keyID != "" }, idemKey)
+	return err
 }
 
-func (ds *Datastore) MarkSent(idemKey string) {
+/* Give a mail that failed (or ran out of tries) or expired another go,
+ * as of when: its tries start again and any deadline is dropped */
+func (ds *SQLiteStore) RetryMail(idemKey string, when time.Time) (int64, error) {
+	stmt := `UPDATE scheduled
+		SET
+			state = 'unsent',
+			try_count = 0,
+			send_at = ?,
+			expires_at = NULL,
+			finished_at = NULL
+		WHERE idem_key = ?
+			AND (state = 'failed' OR state = 'expired')
+			AND stripped_at IS NULL`
+	res, err := ds.Data.Exec(stmt, when.UTC().Unix(), idemKey)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (ds *SQLiteStore) MarkSent(idemKey string, providerID string) error {
 	stmt := `UPDATE scheduled 
 		SET 
-			state = 'sent'
+			state = 'sent',
+			claimed_by = NULL,
+			lease_expires_at = NULL,
+			finished_at = ?,
+			provider_id = ?
 		WHERE idem_key = ?`
-	ds.Data.MustExec(stmt, idemKey)
+	_, err := ds.Data.Exec(stmt, time.Now().UTC().Unix(), providerID, idemKey)
+	return err
+}
+
+func (ds *SQLiteStore) MarkExpired(idemKey string) error {
+	stmt := `UPDATE scheduled 
+		SET 
+			state = 'expired',
+			claimed_by = NULL,
+			lease_expires_at = NULL,
+			finished_at = ?
+		WHERE idem_key = ?`
+	_, err := ds.Data.Exec(stmt, time.Now().UTC().Unix(), idemKey)
+	return err
+}
+
+func (ds *SQLiteStore) GetMail(idemKey string) (*Mail, error) {
+	stmt := `SELECT ` + storedColumns + ` FROM scheduled WHERE idem_key = ?`
+
+	mails, err := ds.selectMails(stmt, idemKey)
+	if err != nil {
+		return &Mail{}, err
+	}
+	if len(mails) == 0 {
+		return &Mail{}, sql.ErrNoRows
+	}
+	return mails[0], nil
 }
 
-func (ds *Datastore) GetMail(idemKey string) (*Mail, error) {
-	stmt := `SELECT job_key, to_addr, to_name, from_addr, from_name, reply_to, title, html_body, text_body, attachments, send_at, state, try_count, mail_domain from scheduled WHERE idem_key = ?`
+func (ds *SQLiteStore) ScheduleMail(m *Mail) error {
+	return ds.insertMail(m, UNSENT, 0, sql.NullString{})
+}
 
-	var mail Mail
-	err := ds.Data.Get(&mail, stmt, idemKey)
-	return &mail, err
+/* Like ScheduleMail, but the mail keeps its state, try count and
+ * provider id, as for mail exported from another mailer */
+func (ds *SQLiteStore) ImportMail(m *Mail) error {
+	return ds.insertMail(m, m.State, m.TryCount, m.ProviderID)
 }
 
-func (ds *Datastore) ScheduleMail(m *Mail) error {
+func (ds *SQLiteStore) insertMail(m *Mail, state ScheduleState, tryCount int, providerID sql.NullString) error {
 	stmt := `INSERT INTO scheduled (
 			idem_key,
 			job_key,
@@ -260,36 +631,631 @@ func (ds *Datastore) ScheduleMail(m *Mail) error {
 			title,
 			html_body,
 			text_body,
-			attachments,
 			send_at,
-			mail_domain
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			mail_domain,
+			priority,
+			expires_at,
+			key_id,
+			state,
+			try_count,
+			provider_id
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := ds.Data.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := m.IdemKey()
+	html, text, keyID, err := ds.sealBodies(key, m.HTMLBody, m.TextBody)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(stmt, key, m.JobKey, m.Sub, m.Missive, m.ToAddr, m.ToName, m.FromAddr, m.FromName, m.ReplyTo, m.Title, html, text, m.SendAt, m.Domain, m.Priority, m.ExpiresAt, keyID, state, tryCount, providerID)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return fmt.Errorf("Mail %s %w", key, ErrAlreadyScheduled)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = attachAll(tx, ds.Keys, key, m.Attachments, m.AttachmentRefs); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	m.Idem = key
+	return nil
+}
+
+/* Store an attachment, if we don't have it already, and return its hash.
+ * Re-uploading restarts the clock on its garbage collection. */
+func (ds *SQLiteStore) PutAttachment(a *Attachment) (string, error) {
+	return putAttachment(ds.Data, ds.Keys, a, time.Now().UTC().Unix())
+}
+
+/* Attachments are sealed against their hash */
+func putAttachment(db sqlx.Execer, keys *Keyring, a *Attachment, now int64) (string, error) {
+	data, err := a.Value()
+	if err != nil {
+		return "", err
+	}
+
+	hash := a.Hash()
+	sealed, keyID, err := keys.Seal(data.([]byte), hash)
+	if err != nil {
+		return "", err
+	}
+
+	stmt := `INSERT INTO attachments (hash, data, size, uploaded_at, key_id) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET uploaded_at = excluded.uploaded_at`
+	_, err = db.Exec(stmt, hash, sealed, len(data.([]byte)), now, sql.NullString{ String: keyID, Valid: keyID != "" })
+	return hash, err
+}
+
+/* Uploaded attachments, in the order asked for */
+func (ds *SQLiteStore) GetAttachments(hashes []string) (AttachSet, error) {
+	as := make(AttachSet, 0, len(hashes))
+	for _, hash := range hashes {
+		var blob struct {
+			Data []byte `db:"data"`
+			KeyID sql.NullString `db:"key_id"`
+		}
+		err := ds.Data.Get(&blob, `SELECT data, key_id FROM attachments WHERE hash = ?`, hash)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("Unknown attachment %s, upload it first", hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ds.Keys.Open(blob.Data, blob.KeyID.String, hash)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open attachment %s: %s", hash, err)
+		}
+
+		a := &Attachment{}
+		if err = a.Plump(data); err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+/* Point the mail at its attachments, in order, replacing any it had */
+func linkAttachments(tx *sqlx.Tx, idemKey string, hashes []string) error {
+	_, err := tx.Exec(`DELETE FROM mail_attachments WHERE idem_key = ?`, idemKey)
+	if err != nil {
+		return err
+	}
+
+	for i, hash := range hashes {
+		stmt := `INSERT INTO mail_attachments (idem_key, seq, hash) VALUES (?, ?, ?)`
+		if _, err = tx.Exec(stmt, idemKey, i, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Store the inline attachments, check the referenced ones have been
+ * uploaded, and link the lot (inline first) to the mail */
+func attachAll(tx *sqlx.Tx, keys *Keyring, idemKey string, inline AttachSet, refs []string) error {
+	now := time.Now().UTC().Unix()
+	hashes := make([]string, 0, len(inline) + len(refs))
+	for _, a := range inline {
+		hash, err := putAttachment(tx, keys, a, now)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	for _, ref := range refs {
+		var count int
+		err := tx.Get(&count, `SELECT count(*) FROM attachments WHERE hash = ?`, ref)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("Unknown attachment %s, upload it first", ref)
+		}
+		hashes = append(hashes, ref)
+	}
+
+	return linkAttachments(tx, idemKey, hashes)
+}
+
+/* Fill in the attachments for mails, in the order they were attached */
+func (ds *SQLiteStore) loadAttachments(mails []*Mail) error {
+	byKey := make(map[string]*Mail, len(mails))
+	for _, m := range mails {
+		m.Attachments = make(AttachSet, 0)
+		byKey[m.Idem] = m
+	}
+
+	/* Keep well under SQLite's limit on variables */
+	const chunk = 500
+	for start := 0; start < len(mails); start += chunk {
+		end := start + chunk
+		if end > len(mails) {
+			end = len(mails)
+		}
+
+		keys := make([]string, 0, end - start)
+		for _, m := range mails[start:end] {
+			keys = append(keys, m.Idem)
+		}
+
+		stmt := `SELECT ma.idem_key, a.hash, a.data, a.key_id
+			FROM mail_attachments ma
+			JOIN attachments a ON a.hash = ma.hash
+			WHERE ma.idem_key IN (?)
+			ORDER BY ma.idem_key, ma.seq`
+		query, args, err := sqlx.In(stmt, keys)
+		if err != nil {
+			return err
+		}
+
+		rows, err := ds.Data.Query(query, args...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var key, hash string
+			var data []byte
+			var keyID sql.NullString
+			if err = rows.Scan(&key, &hash, &data, &keyID); err != nil {
+				rows.Close()
+				return err
+			}
+
+			data, err = ds.Keys.Open(data, keyID.String, hash)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("Unable to open attachment %s: %s", hash, err)
+			}
+
+			a := &Attachment{}
+			if err = a.Plump(data); err != nil {
+				rows.Close()
+				return err
+			}
+			byKey[key].Attachments = append(byKey[key].Attachments, a)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Drop attachments no mail refers to any more. Sent and expired mail
+ * lets go of its attachments when it's purged, not before: it can still
+ * be retried or exported. Anything uploaded in the last grace period
+ * is kept, as it may yet be referenced */
+func (ds *SQLiteStore) CollectAttachments(grace time.Duration) (int64, error) {
+	stmt := `DELETE FROM attachments
+		WHERE uploaded_at <= ?
+			AND NOT EXISTS (
+				SELECT 1 FROM mail_attachments ma
+				WHERE ma.hash = attachments.hash)`
+	res, err := ds.Data.Exec(stmt, time.Now().Add(-grace).UTC().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+/* Rewrite the content of a mail that hasn't gone out yet. The
+ * idem key stays the same; the revision count goes up by one. */
+func (ds *SQLiteStore) EditMail(idemKey string, edit *MailEdit) (int64, error) {
+	return ds.editWhere("idem_key", idemKey, edit)
+}
+
+/* Same as EditMail, for every mail in the missive not yet sent */
+func (ds *SQLiteStore) EditMissive(missive string, edit *MailEdit) (int64, error) {
+	return ds.editWhere("missive", missive, edit)
+}
+
+func (ds *SQLiteStore) editWhere(col string, key string, edit *MailEdit) (int64, error) {
+	var sets []string
+	var args []interface{}
+
+	set := func(col string, val interface{}) {
+		sets = append(sets, col + " = ?")
+		args = append(args, val)
+	}
+	nullable := func(s string) sql.NullString {
+		return sql.NullString{ String: s, Valid: s != "" }
+	}
+
+	if edit.Title != nil {
+		set("title", *edit.Title)
+	}
+	if edit.FromAddr != nil {
+		set("from_addr", nullable(*edit.FromAddr))
+	}
+	if edit.FromName != nil {
+		set("from_name", nullable(*edit.FromName))
+	}
+	if edit.ReplyTo != nil {
+		set("reply_to", nullable(*edit.ReplyTo))
+	}
+
+	rebody := edit.HTMLBody != nil || edit.TextBody != nil
+	relink := edit.Attachments != nil || edit.AttachmentRefs != nil
+	if len(sets) == 0 && !rebody && !relink {
+		return 0, fmt.Errorf("Nothing to edit")
+	}
+	set("edited_at", time.Now().UTC().Unix())
+
+	tx, err := ds.Data.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type bodies struct {
+		IdemKey string `db:"idem_key"`
+		HTMLBody string `db:"html_body"`
+		TextBody string `db:"text_body"`
+		KeyID sql.NullString `db:"key_id"`
+	}
+
+	var mails []bodies
+	stmt := fmt.Sprintf(`SELECT idem_key, html_body, text_body, key_id FROM scheduled
+		WHERE %s = ?
+			AND (state = 'unsent' OR state = 'failed' OR state = 'paused')`, col)
+	if err = tx.Select(&mails, stmt, key); err != nil {
+		return 0, err
+	}
+
+	/* Bodies are sealed per mail, so each gets its own update */
+	var blank int
+	for _, m := range mails {
+		rowSets := append([]string{}, sets...)
+		rowArgs := append([]interface{}{}, args...)
+
+		if rebody {
+			html, text, err := ds.openBodies(m.IdemKey, m.HTMLBody, m.TextBody, m.KeyID.String)
+			if err != nil {
+				return 0, fmt.Errorf("Unable to open mail %s: %s", m.IdemKey, err)
+			}
+			if edit.HTMLBody != nil {
+				html = *edit.HTMLBody
+			}
+			if edit.TextBody != nil {
+				text = *edit.TextBody
+			}
+
+			/* Don't leave anything without a body to send */
+			if html == "" && text == "" {
+				blank++
+				continue
+			}
+
+			html, text, keyID, err := ds.sealBodies(m.IdemKey, html, text)
+			if err != nil {
+				return 0, err
+			}
+			rowSets = append(rowSets, "html_body = ?", "text_body = ?", "key_id = ?")
+			rowArgs = append(rowArgs, html, text, keyID)
+		}
+
+		update := fmt.Sprintf(`UPDATE scheduled
+			SET %s, revision = revision + 1
+			WHERE idem_key = ?`, strings.Join(rowSets, ", "))
+		if _, err = tx.Exec(update, append(rowArgs, m.IdemKey)...); err != nil {
+			return 0, err
+		}
+	}
+	if blank > 0 {
+		return 0, fmt.Errorf("Edit would leave %d mails with neither html_body nor text_body", blank)
+	}
+
+	/* A new set of attachments replaces the old one outright */
+	if relink {
+		var inline AttachSet
+		var refs []string
+		if edit.Attachments != nil {
+			inline = *edit.Attachments
+		}
+		if edit.AttachmentRefs != nil {
+			refs = *edit.AttachmentRefs
+		}
+		for _, m := range mails {
+			if err = attachAll(tx, ds.Keys, m.IdemKey, inline, refs); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return int64(len(mails)), tx.Commit()
+}
 
-	_, err := ds.Data.Exec(stmt, m.IdemKey(), m.JobKey, m.Sub, m.Missive, m.ToAddr, m.ToName, m.FromAddr, m.FromName, m.ReplyTo, m.Title, m.HTMLBody, m.TextBody, m.Attachments, m.SendAt, m.Domain)
+/* Retention for mail that's done with, sent or expired. Mail finished
+ * before stripBefore keeps only a metadata record: the recipient is
+ * replaced by a hash of their address, and bodies and attachments
+ * are dropped. Mail finished before deleteBefore goes altogether.
+ * A zero time skips that step. */
+func (ds *SQLiteStore) PurgeFinished(stripBefore time.Time, deleteBefore time.Time) (stripped int64, deleted int64, err error) {
+	tx, err := ds.Data.Beginx()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	/* Mail finished before we kept track goes by its send time */
+	if !deleteBefore.IsZero() {
+		stmt := `DELETE FROM scheduled
+			WHERE (state = 'sent' OR state = 'expired')
+				AND COALESCE(finished_at, send_at) <= ?`
+		res, err := tx.Exec(stmt, deleteBefore.UTC().Unix())
+		if err != nil {
+			return 0, 0, err
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return 0, 0, err
+		}
+	}
 
+	if !stripBefore.IsZero() {
+		type recipient struct {
+			IdemKey string `db:"idem_key"`
+			ToAddr string `db:"to_addr"`
+		}
+
+		var mails []recipient
+		stmt := `SELECT idem_key, to_addr FROM scheduled
+			WHERE (state = 'sent' OR state = 'expired')
+				AND stripped_at IS NULL
+				AND COALESCE(finished_at, send_at) <= ?`
+		if err = tx.Select(&mails, stmt, stripBefore.UTC().Unix()); err != nil {
+			return 0, 0, err
+		}
+
+		now := time.Now().UTC().Unix()
+		for _, m := range mails {
+			strip := `UPDATE scheduled
+				SET
+					recipient_hash = ?,
+					to_addr = '',
+					to_name = NULL,
+					html_body = '',
+					text_body = '',
+					last_error = NULL,
+					error_key_id = NULL,
+					stripped_at = ?
+				WHERE idem_key = ?`
+			if _, err = tx.Exec(strip, RecipientHash(m.ToAddr), now, m.IdemKey); err != nil {
+				return 0, 0, err
+			}
+			if err = linkAttachments(tx, m.IdemKey, nil); err != nil {
+				return 0, 0, err
+			}
+		}
+		stripped = int64(len(mails))
+	}
+
+	return stripped, deleted, tx.Commit()
+}
+
+/* Audit entries can be added, never changed or removed; the
+ * table's triggers refuse */
+func (ds *SQLiteStore) RecordAudit(entry *AuditEntry) error {
+	stmt := `INSERT INTO audit_log (at, client, remote_addr, action, target, target_key, count)
+		VALUES (:at, :client, :remote_addr, :action, :target, :target_key, :count)`
+	res, err := ds.Data.NamedExec(stmt, entry)
+	if err != nil {
+		return err
+	}
+	entry.ID, err = res.LastInsertId()
 	return err
 }
 
-func (ds *Datastore) ResetInProgress() {
-	stmt := `UPDATE scheduled SET state = 'failed' WHERE state = 'inprog';`
-	ds.Data.MustExec(stmt)
+/* Newest first. before is the id to page back from; 0 for the latest */
+func (ds *SQLiteStore) FindAudit(filter *AuditFilter, before int64, limit int) ([]*AuditEntry, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+
+	if before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, before)
+	}
+	if filter.Client != "" {
+		where = append(where, "client = ?")
+		args = append(args, filter.Client)
+	}
+	if filter.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Key != "" {
+		where = append(where, "target_key = ?")
+		args = append(args, filter.Key)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "at >= ?")
+		args = append(args, filter.Since.UTC().Unix())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "at < ?")
+		args = append(args, filter.Until.UTC().Unix())
+	}
+
+	var entries []*AuditEntry
+	stmt := `SELECT id, at, client, remote_addr, action, target, target_key, count
+		FROM audit_log
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY id DESC
+		LIMIT ?`
+	err := ds.Data.Select(&entries, stmt, append(args, limit)...)
+	return entries, err
 }
 
-type Datastore struct {
+/* Give space freed by purging back to the filesystem. That takes a
+ * database switched to incremental vacuuming (mailer migrate vacuum);
+ * until it is, this does nothing */
+func (ds *SQLiteStore) Vacuum() error {
+	/* PRAGMAs are per connection, so stick to one */
+	conn, err := ds.Data.Connx(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err = conn.GetContext(context.Background(), &mode, `PRAGMA auto_vacuum`); err != nil {
+		return err
+	}
+
+	/* 2 is INCREMENTAL */
+	if mode != 2 {
+		slog.Debug("Database isn't set up for incremental vacuum, skipping it")
+		return nil
+	}
+
+	_, err = conn.ExecContext(context.Background(), `PRAGMA incremental_vacuum`)
+	return err
+}
+
+/* Re-seal up to batchSize mails and attachments that are in the clear,
+ * or under a key other than the current one, with the current key.
+ * Returns how many were rewritten; after rotating keys, run it until
+ * that comes back 0 before dropping the old key. */
+func (ds *SQLiteStore) Reencrypt(batchSize int) (int64, error) {
+	current := ds.Keys.Current()
+	if current == "" {
+		return 0, nil
+	}
+
+	tx, err := ds.Data.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var mails []storedMail
+	stmt := `SELECT idem_key, html_body, text_body, key_id FROM scheduled
+		WHERE key_id IS NOT ? AND (html_body != '' OR text_body != '')
+		LIMIT ?`
+	if err = tx.Select(&mails, stmt, current, batchSize); err != nil {
+		return 0, err
+	}
+
+	for _, m := range mails {
+		html, text, err := ds.openBodies(m.Idem, m.HTMLBody, m.TextBody, m.KeyID.String)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to open mail %s: %s", m.Idem, err)
+		}
+		html, text, keyID, err := ds.sealBodies(m.Idem, html, text)
+		if err != nil {
+			return 0, err
+		}
+
+		update := `UPDATE scheduled SET html_body = ?, text_body = ?, key_id = ? WHERE idem_key = ?`
+		if _, err = tx.Exec(update, html, text, keyID, m.Idem); err != nil {
+			return 0, err
+		}
+	}
+
+	/* Including errors saved before they were sealed */
+	var errs []storedMail
+	stmt = `SELECT idem_key, last_error, error_key_id FROM scheduled
+		WHERE error_key_id IS NOT ? AND last_error != ''
+		LIMIT ?`
+	if err = tx.Select(&errs, stmt, current, batchSize); err != nil {
+		return 0, err
+	}
+
+	for _, m := range errs {
+		if err = ds.openLastError(&m); err != nil {
+			return 0, fmt.Errorf("Unable to open mail %s: %s", m.Idem, err)
+		}
+		sealed, keyID, err := ds.Keys.SealString(m.LastError.String, bodyAAD(m.Idem, "last_error"))
+		if err != nil {
+			return 0, err
+		}
+
+		update := `UPDATE scheduled SET last_error = ?, error_key_id = ? WHERE idem_key = ?`
+		if _, err = tx.Exec(update, sealed, sql.NullString{ String: keyID, Valid: keyID != "" }, m.Idem); err != nil {
+			return 0, err
+		}
+	}
+
+	type blob struct {
+		Hash string `db:"hash"`
+		Data []byte `db:"data"`
+		KeyID sql.NullString `db:"key_id"`
+	}
+
+	var blobs []blob
+	stmt = `SELECT hash, data, key_id FROM attachments WHERE key_id IS NOT ? LIMIT ?`
+	if err = tx.Select(&blobs, stmt, current, batchSize); err != nil {
+		return 0, err
+	}
+
+	for _, b := range blobs {
+		data, err := ds.Keys.Open(b.Data, b.KeyID.String, b.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to open attachment %s: %s", b.Hash, err)
+		}
+		sealed, keyID, err := ds.Keys.Seal(data, b.Hash)
+		if err != nil {
+			return 0, err
+		}
+
+		update := `UPDATE attachments SET data = ?, key_id = ? WHERE hash = ?`
+		if _, err = tx.Exec(update, sealed, keyID, b.Hash); err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(mails) + len(errs) + len(blobs)), tx.Commit()
+}
+
+/* Only claims without a live lease are reset, so that starting up
+ * doesn't steal mails from another instance sharing the database */
+func (ds *SQLiteStore) ResetInProgress() error {
+	stmt := `UPDATE scheduled
+		SET state = 'failed', claimed_by = NULL, lease_expires_at = NULL
+		WHERE state = 'inprog'
+			AND (lease_expires_at IS NULL OR lease_expires_at <= ?);`
+	_, err := ds.Data.Exec(stmt, time.Now().UTC().Unix())
+	return err
+}
+
+type SQLiteStore struct {
 	Data *sqlx.DB
+	/* Seals bodies and attachments at rest; nil leaves them in the clear */
+	Keys *Keyring
 }
 
 /* Service that you can schedule emails to send out */
-func DatastoreNew(dbConn string) (*Datastore, error) {
-	err := initDatabase(dbConn)
+func SQLiteStoreNew(dbConn string) (*SQLiteStore, error) {
+	db, err := initDatabase(dbConn)
 	if err != nil {
 		return nil, err
 	}
 
-	ds := &Datastore{ Data: db, }
+	ds := &SQLiteStore{ Data: db, }
 
 	/* Always reset on start */
-	ds.ResetInProgress()
+	if err = ds.ResetInProgress(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to reset claims left in progress: %w", err)
+	}
 
 	return ds, nil
 }
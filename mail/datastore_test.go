@@ -1,15 +1,23 @@
 package mail
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	tt "testing"
 	"time"
 	"github.com/google/go-cmp/cmp"
+	"github.com/jmoiron/sqlx"
 )
 
-func getDatastore(t *tt.T) *Datastore {
-	ds, err := DatastoreNew(":memory:")
+func getDatastore(t *tt.T) *SQLiteStore {
+	ds, err := SQLiteStoreNew(":memory:")
 	if err != nil {
 		t.Errorf("was not expecting err %s", err)
 	}
@@ -19,35 +27,217 @@ func getDatastore(t *tt.T) *Datastore {
 func TestDatstoreInit(t *tt.T) {
 	ds := getDatastore(t)
 
-	/* Check that the metadata table exists? */
-	stmt := `SELECT key, value FROM db_metadata;`
-	rows, err := ds.Data.Queryx(stmt)
+	/* Everything applied, and recorded */
+	var count int
+	err := ds.Data.Get(&count, `SELECT count(*) FROM schema_migrations;`)
 	if err != nil {
 		t.Errorf("was not expecting err %s", err)
 	}
+	if count != len(db_migrations) {
+		t.Errorf("expecting %d, got %d", len(db_migrations), count)
+	}
+
+	status, err := migrationStatus(ds.Data)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	for _, s := range status {
+		if s.State != "applied" {
+			t.Errorf("expecting migration %d applied, got %s", s.Version, s.State)
+		}
+	}
+}
 
-	rows.Next()
+func TestMigrationVersions(t *tt.T) {
+	names := make(map[string]bool)
+	for i, m := range db_migrations {
+		if i > 0 && m.version <= db_migrations[i - 1].version {
+			t.Errorf("expecting versions to go up, got %d after %d", m.version, db_migrations[i - 1].version)
+		}
+		if names[m.name] {
+			t.Errorf("migration name %s used twice", m.name)
+		}
+		names[m.name] = true
+	}
+}
 
-	var k, v string
-	err = rows.Scan(&k, &v)
+func TestMigrateDownUp(t *tt.T) {
+	ds := getDatastore(t)
+	mg := &Migrator{ db: ds.Data }
+
+	/* Back to before key_id */
+	steps := len(db_migrations) - 21
+	count, err := mg.Down(steps)
 	if err != nil {
 		t.Errorf("was not expecting err %s", err)
 	}
-	if k != "migrations" {
-		t.Errorf("expecting %s, got %s", "migrations", k)
+	if count != steps {
+		t.Errorf("expecting %d undone, got %d", steps, count)
+	}
+
+	var cols int
+	ds.Data.Get(&cols, `SELECT count(*) FROM pragma_table_info('scheduled') WHERE name IN ('key_id', 'last_error')`)
+	if cols != 0 {
+		t.Errorf("expecting key_id and last_error to be dropped")
+	}
+
+	status, _ := mg.Status()
+	for _, s := range status[len(status) - steps:] {
+		if s.State != "pending" {
+			t.Errorf("expecting migration %d pending, got %s", s.Version, s.State)
+		}
+	}
+
+	if count, err = mg.Up(); err != nil || count != steps {
+		t.Errorf("expecting %d applied, got %d (err %v)", steps, count, err)
+	}
+
+	/* Only so far back as there are down steps */
+	count, err = mg.Down(len(db_migrations))
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+	if count != len(db_migrations) - 17 {
+		t.Errorf("expecting %d undone, got %d", len(db_migrations) - 17, count)
+	}
+}
+
+func TestMigrationChecks(t *tt.T) {
+	ds := getDatastore(t)
+
+	ds.Data.MustExec(`UPDATE schema_migrations SET checksum = 'x' WHERE version = 3`)
+	status, _ := migrationStatus(ds.Data)
+	if status[2].State != "edited" {
+		t.Errorf("expecting %s, got %s", "edited", status[2].State)
+	}
+
+	/* A database from a newer mailer */
+	ds.Data.MustExec(`INSERT INTO schema_migrations VALUES (9999, 'from_the_future', '', 0)`)
+	if _, err := migrateUp(ds.Data); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+}
+
+/* Databases from before schema_migrations have an index in db_metadata */
+func TestMigrationsCarriedOver(t *tt.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	db.MustExec(`CREATE TABLE db_metadata (key TEXT NOT NULL PRIMARY KEY, value TEXT);`)
+	db.MustExec(`INSERT INTO db_metadata (key, value) values ('migrations', 1);`)
+	db.MustExec(db_migrations[0].stmt)
+	db.MustExec(db_migrations[1].stmt)
+
+	if err = setupTables(db); err != nil {
+		t.Errorf("was not expecting err %s", err)
 	}
-	val, err  := strconv.ParseInt(v, 10, 32)
+	count, err := migrateUp(db)
 	if err != nil {
 		t.Errorf("was not expecting err %s", err)
 	}
+	if count != len(db_migrations) - 2 {
+		t.Errorf("expecting %d applied, got %d", len(db_migrations) - 2, count)
+	}
+
+	var left int
+	db.Get(&left, `SELECT count(*) FROM db_metadata WHERE key = 'migrations'`)
+	if left != 0 {
+		t.Errorf("expecting the old index to be gone")
+	}
+}
+
+/* A database as the first mailer left it, mail with attachments and
+ * all, upgrades through every migration */
+func TestMigrateBaseline(t *tt.T) {
+	path := filepath.Join(t.TempDir(), "mail.db")
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	db.MustExec(`CREATE TABLE db_metadata (key TEXT NOT NULL PRIMARY KEY, value TEXT);`)
+	db.MustExec(`INSERT INTO db_metadata (key, value) values ('migrations', 3);`)
+	for _, m := range db_migrations[:4] {
+		db.MustExec(m.stmt)
+	}
+
+	syllabus := &Attachment{ Name: "syllabus.txt", Type: "text/plain", Content: []byte("week 1: keys") }
+	attachments, _ := AttachSet{ syllabus }.Value()
+	stmt := `INSERT INTO scheduled (idem_key, job_key, to_addr, title, html_body, text_body, attachments, send_at, mail_domain)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, key := range []string{ "one", "two" } {
+		db.MustExec(stmt, key, "course", key + "@example.com", "Syllabus", "", "see attached", attachments, 1, "")
+	}
+	db.Close()
+
+	ds, err := SQLiteStoreNew(path)
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	defer ds.Data.Close()
+
+	status, _ := migrationStatus(ds.Data)
+	for _, s := range status {
+		if s.State != "applied" {
+			t.Errorf("expecting migration %d applied, got %s", s.Version, s.State)
+		}
+	}
+
+	for _, key := range []string{ "one", "two" } {
+		m, err := ds.GetMail(key)
+		if err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		if !cmp.Equal(m.Attachments, AttachSet{ syllabus }) {
+			t.Errorf("was expecting %+v, got %+v", AttachSet{ syllabus }, m.Attachments)
+		}
+	}
+
+	var blobs int
+	ds.Data.Get(&blobs, `SELECT count(*) FROM attachments`)
+	if blobs != 1 {
+		t.Errorf("expecting %d attachments, got %d", 1, blobs)
+	}
+}
+
+/* Every Datastore should behave the same; these run against each */
+var datastoreTests = map[string]func(*tt.T, Datastore){
+	"DataSaveMail": testDataSaveMail,
+	"ClaimLease": testClaimLease,
+	"KeepUnrecorded": testKeepUnrecorded,
+	"NextSendAt": testNextSendAt,
+	"PriorityBatch": testPriorityBatch,
+	"ExpireStale": testExpireStale,
+	"PauseResume": testPauseResume,
+	"EditMail": testEditMail,
+	"SharedAttachments": testSharedAttachments,
+	"PurgeFinished": testPurgeFinished,
+	"ExportImport": testExportImport,
+	"QueueStats": testQueueStats,
+	"RetryCancel": testRetryCancel,
+	"Audit": testAudit,
+	"ScheduleReplay": testScheduleReplay,
+	"DashboardCounts": testDashboardCounts,
+}
+
+func TestDatastores(t *tt.T) {
+	backends := map[string]func(*tt.T) Datastore{
+		"sqlite": func(t *tt.T) Datastore { return getDatastore(t) },
+		"memory": func(t *tt.T) Datastore { return MemStoreNew() },
+	}
 
-	if int(val) != ds.CountMigrations() - 1 {
-		t.Errorf("expecting %d, got %s", ds.CountMigrations() - 1, v)
+	for backend, newStore := range backends {
+		for name, test := range datastoreTests {
+			t.Run(backend + "/" + name, func(t *tt.T) {
+				test(t, newStore(t))
+			})
+		}
 	}
 }
 
-func checkMailState(t *tt.T, ds *Datastore, checkState ScheduleState, count int) {
-	for _, state := range []ScheduleState { UNSENT, INPROG, FAILED, SENT} {
+func checkMailState(t *tt.T, ds Datastore, checkState ScheduleState, count int) {
+	for _, state := range []ScheduleState { UNSENT, INPROG, FAILED, SENT, EXPIRED} {
 		mails, err := ds.ListJobs(&state)
 
 		if err != nil {
@@ -66,8 +256,7 @@ func checkMailState(t *tt.T, ds *Datastore, checkState ScheduleState, count int)
 	}
 }
 
-func TestDataSaveMail(t *tt.T) {
-	ds := getDatastore(t)
+func testDataSaveMail(t *tt.T, ds Datastore) {
 
 	/* Put some mail in! */
 	mail := &Mail{
@@ -98,8 +287,8 @@ func TestDataSaveMail(t *tt.T) {
 
 	/* Try to reinsert */
 	err = ds.ScheduleMail(mail)
-	if err == nil {
-		t.Errorf("was expecting err, didn't get one")
+	if !errors.Is(err, ErrAlreadyScheduled) {
+		t.Errorf("expecting %s, got %v", ErrAlreadyScheduled, err)
 	}
 	checkMailState(t, ds, UNSENT, 1)
 
@@ -137,13 +326,1237 @@ func TestDataSaveMail(t *tt.T) {
 	checkMailState(t, ds, INPROG, 1)
 
 	/* Reset state to "failed" 'on start' */
-	ds.ResetInProgress()
+	if err = ds.ResetInProgress(); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
 	checkMailState(t, ds, FAILED, 1)
 
 	/* Test deleting a job! */
-	ds.DeleteJob(mail.JobKey)
+	deleted, err := ds.DeleteJob(mail.JobKey)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expecting %d deleted, got %d", 1, deleted)
+	}
 	mails, _ = ds.GetJob(mail.JobKey)
 	if len(mails) > 0 {
 		t.Errorf("was expecting mails to be gone")
 	}
 }
+
+/* A mail the provider took, but that couldn't be marked sent, isn't
+ * handed back with the rest of the claims */
+func testKeepUnrecorded(t *tt.T, ds Datastore) {
+	now := time.Now()
+	lease := 5 * time.Minute
+	var keys []string
+	for _, addr := range []string{"a@example.com", "b@example.com"} {
+		m := &Mail{
+			JobKey: "lease",
+			ToAddr: addr,
+			Title: "Leased email",
+			TextBody: "hello!",
+			SendAt: Timestamp(now.Add(-time.Minute)),
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.IdemKey())
+	}
+
+	if mails, _ := ds.GetToSendBatch(now, 10, "worker-a", lease); len(mails) != 2 {
+		t.Fatalf("expecting %d mails, got %d", 2, len(mails))
+	}
+	released, err := ds.ReleaseClaims("worker-a", keys[0])
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if released != 1 {
+		t.Errorf("expecting %d released, got %d", 1, released)
+	}
+
+	/* Only the other one goes out again before the lease is up */
+	mails, _ := ds.GetToSendBatch(now, 10, "worker-b", lease)
+	if len(mails) != 1 || mails[0].IdemKey() != keys[1] {
+		t.Errorf("expecting only %s to be claimed, got %d mails", keys[1], len(mails))
+	}
+
+	/* Recording it later finishes it off */
+	if err = ds.MarkSent(keys[0], "provider-id"); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	m, _ := ds.GetMail(keys[0])
+	if m.State != SENT {
+		t.Errorf("expecting %s, got %s", SENT, m.State)
+	}
+	if mails, _ = ds.GetToSendBatch(now.Add(lease + time.Second), 10, "worker-c", lease); len(mails) != 1 {
+		t.Errorf("expecting %d mails, got %d", 1, len(mails))
+	}
+}
+
+func testClaimLease(t *tt.T, ds Datastore) {
+
+	now := time.Now()
+	lease := 5 * time.Minute
+	for _, addr := range []string{"a@example.com", "b@example.com"} {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "lease",
+			ToAddr: addr,
+			Title: "Leased email",
+			TextBody: "hello!",
+			SendAt: Timestamp(now.Add(-time.Minute)),
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+
+	mails, err := ds.GetToSendBatch(now, 10, "worker-a", lease)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(mails) != 2 {
+		t.Errorf("expecting %d mails, got %d", 2, len(mails))
+	}
+	checkMailState(t, ds, INPROG, 2)
+
+	/* Another worker can't take a live claim */
+	mails, err = ds.GetToSendBatch(now, 10, "worker-b", lease)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(mails) != 0 {
+		t.Errorf("expecting %d mails, got %d", 0, len(mails))
+	}
+
+	/* Nor does starting up reset it */
+	ds.ResetInProgress()
+	checkMailState(t, ds, INPROG, 2)
+
+	/* ...but can once the lease has run out */
+	later := now.Add(lease + time.Second)
+	mails, err = ds.GetToSendBatch(later, 1, "worker-b", lease)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(mails) != 1 {
+		t.Fatalf("expecting %d mails, got %d", 1, len(mails))
+	}
+	if mails[0].TryCount != 1 {
+		t.Errorf("expecting lost claim to count as a try, got %d", mails[0].TryCount)
+	}
+
+	/* Releasing only hands back the releasing worker's claims */
+	released, err := ds.ReleaseClaims("worker-b")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if released != 1 {
+		t.Errorf("expecting %d released, got %d", 1, released)
+	}
+
+	released, err = ds.ReleaseClaims("worker-a")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if released != 1 {
+		t.Errorf("expecting %d released, got %d", 1, released)
+	}
+
+	/* The untried mail is unsent again, the reclaimed one failed */
+	unsent := UNSENT
+	mails, _ = ds.ListJobs(&unsent)
+	if len(mails) != 1 {
+		t.Errorf("expecting %d unsent, got %d", 1, len(mails))
+	}
+	failed := FAILED
+	mails, _ = ds.ListJobs(&failed)
+	if len(mails) != 1 {
+		t.Errorf("expecting %d failed, got %d", 1, len(mails))
+	}
+}
+
+func testNextSendAt(t *tt.T, ds Datastore) {
+
+	_, ok, err := ds.NextSendAt()
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if ok {
+		t.Errorf("wasn't expecting anything to send")
+	}
+
+	soon := time.Unix(time.Now().Unix() + 60, 0)
+	for i, at := range []time.Time{soon.Add(time.Hour), soon} {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "next",
+			ToAddr: "next@example.com",
+			Title: strconv.Itoa(i),
+			TextBody: "hello!",
+			SendAt: Timestamp(at),
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+
+	next, ok, err := ds.NextSendAt()
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if !ok || !next.Equal(soon) {
+		t.Errorf("expecting %s, got %s (%t)", soon, next, ok)
+	}
+
+	/* Once claimed, the lease expiry is what's next */
+	lease := time.Minute
+	mails, _ := ds.GetToSendBatch(soon.Add(time.Hour), 1, "worker", lease)
+	if len(mails) != 1 {
+		t.Fatalf("expecting %d mails, got %d", 1, len(mails))
+	}
+	next, _, _ = ds.NextSendAt()
+	if !next.Equal(soon.Add(time.Hour)) {
+		t.Errorf("expecting %s, got %s", soon.Add(time.Hour), next)
+	}
+}
+
+func testPriorityBatch(t *tt.T, ds Datastore) {
+
+	start := time.Now().Add(-time.Hour)
+	schedule := func(job string, n int, prio Priority) {
+		for i := 0; i < n; i++ {
+			err := ds.ScheduleMail(&Mail{
+				JobKey: job,
+				ToAddr: strconv.Itoa(i) + "@example.com",
+				Title: job,
+				TextBody: "hello!",
+				SendAt: Timestamp(start.Add(time.Duration(i) * time.Minute)),
+				Priority: prio,
+			})
+			if err != nil {
+				t.Errorf("was not expecting err %s", err)
+			}
+		}
+	}
+
+	/* A big announcement, a smaller one, then a receipt due last */
+	schedule("announce", 5, PriorityNormal)
+	schedule("digest", 2, PriorityLow)
+	schedule("reminder", 2, PriorityNormal)
+	schedule("receipt", 1, PriorityHigh)
+
+	mails, err := ds.GetToSendBatch(time.Now(), 5, "worker", time.Minute)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+
+	/* announce and reminder start at the same time; job key settles it */
+	exp := []string{"receipt", "announce", "reminder", "announce", "reminder"}
+	got := make([]string, len(mails))
+	for i, m := range mails {
+		got[i] = m.JobKey
+	}
+	if !cmp.Equal(exp, got) {
+		t.Errorf("was expecting %v, got %v", exp, got)
+	}
+
+	/* Same job, same time: by idem key */
+	var keys []string
+	for i := 0; i < 3; i++ {
+		m := &Mail{
+			JobKey: "tied",
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "tied",
+			TextBody: "hello!",
+			SendAt: Timestamp(start),
+			Priority: PriorityHigh,
+		}
+		if err = ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.IdemKey())
+	}
+	sort.Strings(keys)
+
+	mails, err = ds.GetToSendBatch(time.Now(), 3, "other-worker", time.Minute)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	got = make([]string, len(mails))
+	for i, m := range mails {
+		got[i] = m.IdemKey()
+	}
+	if !cmp.Equal(keys, got) {
+		t.Errorf("was expecting %v, got %v", keys, got)
+	}
+}
+
+func testExpireStale(t *tt.T, ds Datastore) {
+
+	now := time.Now()
+	for i, expires := range []int64{0, now.Add(-time.Minute).Unix(), now.Add(time.Hour).Unix()} {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "expiring",
+			ToAddr: "class@example.com",
+			Title: strconv.Itoa(i),
+			TextBody: "class is starting!",
+			SendAt: Timestamp(now.Add(-time.Hour)),
+			ExpiresAt: sql.NullInt64{Int64: expires, Valid: expires != 0},
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+
+	/* Even unclaimed, stale mail can't be picked up */
+	mails, err := ds.GetToSendBatch(now, 10, "worker", time.Minute)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(mails) != 2 {
+		t.Errorf("expecting %d mails, got %d", 2, len(mails))
+	}
+	ds.ReleaseClaims("worker")
+
+	count, err := ds.ExpireStale(now)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 1 {
+		t.Errorf("expecting %d expired, got %d", 1, count)
+	}
+
+	/* Live claims are left alone, even past their deadline */
+	ds.GetToSendBatch(now, 10, "worker", 3 * time.Hour)
+	count, _ = ds.ExpireStale(now.Add(2 * time.Hour))
+	if count != 0 {
+		t.Errorf("expecting %d expired, got %d", 0, count)
+	}
+
+	expired := EXPIRED
+	mails, _ = ds.ListJobs(&expired)
+	if len(mails) != 1 || mails[0].Title != "1" {
+		t.Errorf("expecting mail %q to have expired, got %+v", "1", mails)
+	}
+}
+
+func testPauseResume(t *tt.T, ds Datastore) {
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "announce",
+			Missive: sql.NullString{String: "typo", Valid: true},
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Announcment",
+			TextBody: "hello!",
+			SendAt: Timestamp(now.Add(-time.Minute)),
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+
+	count, err := ds.Pause(PauseMissive, "typo")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 3 {
+		t.Errorf("expecting %d paused, got %d", 3, count)
+	}
+	checkMailState(t, ds, PAUSED, 3)
+
+	/* Paused mail isn't up for sending */
+	mails, _ := ds.GetToSendBatch(now, 10, "worker", time.Minute)
+	if len(mails) != 0 {
+		t.Errorf("expecting %d mails, got %d", 0, len(mails))
+	}
+
+	count, err = ds.Resume(PauseJob, "announce")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 3 {
+		t.Errorf("expecting %d resumed, got %d", 3, count)
+	}
+	checkMailState(t, ds, UNSENT, 3)
+
+	/* Now the kill switch */
+	paused, err := ds.IsPaused()
+	if err != nil || paused {
+		t.Errorf("expecting not paused, got %t (%v)", paused, err)
+	}
+	for _, set := range []bool{true, false} {
+		if err = ds.SetPaused(set); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		paused, _ = ds.IsPaused()
+		if paused != set {
+			t.Errorf("expecting paused %t, got %t", set, paused)
+		}
+	}
+}
+
+func testEditMail(t *tt.T, ds Datastore) {
+
+	now := time.Now()
+	var mails []*Mail
+	for i := 0; i < 3; i++ {
+		m := &Mail{
+			JobKey: "course",
+			Missive: sql.NullString{String: "week-1", Valid: true},
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Wekk 1 starts!",
+			HTMLBody: "<p>see you tmorrow</p>",
+			SendAt: Timestamp(now.Add(time.Hour)),
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		mails = append(mails, m)
+	}
+	ds.MarkSent(mails[2].IdemKey(), "<sent@example.com>")
+
+	/* Fix the subject line on just one */
+	title := "Week 1 starts!"
+	count, err := ds.EditMail(mails[0].IdemKey(), &MailEdit{Title: &title})
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 1 {
+		t.Errorf("expecting %d edited, got %d", 1, count)
+	}
+
+	res, err := ds.GetMail(mails[0].IdemKey())
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if res.Title != title || res.Revision != 1 {
+		t.Errorf("expecting title %q at revision 1, got %q at %d", title, res.Title, res.Revision)
+	}
+	if res.IdemKey() != mails[0].IdemKey() {
+		t.Errorf("expecting idem key to stay %s, got %s", mails[0].IdemKey(), res.IdemKey())
+	}
+
+	/* Then the body, missive wide. Sent mail is left be */
+	body := "<p>see you tomorrow</p>"
+	count, err = ds.EditMissive("week-1", &MailEdit{HTMLBody: &body})
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 2 {
+		t.Errorf("expecting %d edited, got %d", 2, count)
+	}
+	res, _ = ds.GetMail(mails[2].IdemKey())
+	if res.HTMLBody != mails[2].HTMLBody || res.Revision != 0 {
+		t.Errorf("wasn't expecting sent mail to change, got %+v", res)
+	}
+
+	/* Can't edit away the only body */
+	blank := ""
+	_, err = ds.EditMissive("week-1", &MailEdit{HTMLBody: &blank})
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+	res, _ = ds.GetMail(mails[1].IdemKey())
+	if res.HTMLBody != body {
+		t.Errorf("expecting failed edit to roll back, got %q", res.HTMLBody)
+	}
+
+	_, err = ds.EditMail(mails[1].IdemKey(), &MailEdit{})
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+}
+
+func TestRekeyIdemKeys(t *tt.T) {
+	ds := getDatastore(t)
+
+	legacy := func(job, to, title string) string {
+		h := sha256.New()
+		h.Write([]byte(job + to + title))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	/* One untouched mail, one edited since it was keyed */
+	insert := `INSERT INTO scheduled (idem_key, job_key, to_addr, title, html_body, text_body, send_at, mail_domain)
+		VALUES (?, ?, ?, ?, '', 'hi', 0, '')`
+	ds.Data.MustExec(insert, legacy("job", "a@x", "hi"), "job", "a@x", "hi")
+	ds.Data.MustExec(insert, legacy("job", "b@x", "typo"), "job", "b@x", "fixed")
+
+	tx := ds.Data.MustBegin()
+	if err := rekeyIdemKeys(tx); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	tx.Commit()
+
+	for _, key := range []string{deriveIdemKey("job", "a@x", "hi"), legacy("job", "b@x", "typo")} {
+		if _, err := ds.GetMail(key); err != nil {
+			t.Errorf("expecting mail under %s, got err %s", key, err)
+		}
+	}
+}
+
+func testSharedAttachments(t *tt.T, ds Datastore) {
+	syllabus := &Attachment{
+		Content: []byte("week 1: keys; week 2: scripts"),
+		Type: "text/plain",
+		Name: "syllabus.txt",
+	}
+
+	hash, err := ds.PutAttachment(syllabus)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if hash != syllabus.Hash() {
+		t.Errorf("expecting %s, got %s", syllabus.Hash(), hash)
+	}
+
+	got, err := ds.GetAttachments([]string{hash})
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if !cmp.Equal(got, AttachSet{syllabus}) {
+		t.Errorf("was expecting %+v, got %+v", AttachSet{syllabus}, got)
+	}
+	if _, err = ds.GetAttachments([]string{hash, "deadbeef"}); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	/* One sends it inline, the others by reference */
+	var keys []string
+	for i := 0; i < 3; i++ {
+		m := &Mail{
+			JobKey: "course",
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Syllabus",
+			TextBody: "see attached",
+			SendAt: Timestamp(time.Now()),
+		}
+		if i == 0 {
+			m.Attachments = AttachSet{syllabus}
+		} else {
+			m.AttachmentRefs = []string{hash}
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.IdemKey())
+	}
+
+	for _, key := range keys {
+		m, err := ds.GetMail(key)
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		if !cmp.Equal(m.Attachments, AttachSet{syllabus}) {
+			t.Errorf("was expecting %+v, got %+v", AttachSet{syllabus}, m.Attachments)
+		}
+	}
+
+	/* Refs have to have been uploaded */
+	err = ds.ScheduleMail(&Mail{
+		JobKey: "course",
+		ToAddr: "late@example.com",
+		Title: "Syllabus",
+		TextBody: "see attached",
+		AttachmentRefs: []string{"deadbeef"},
+	})
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+	mails, _ := ds.GetJob("course")
+	if len(mails) != 3 {
+		t.Errorf("expecting %d mails, got %d", 3, len(mails))
+	}
+
+	/* Nothing to collect while there's mail to send */
+	count, err := ds.CollectAttachments(0)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 0 {
+		t.Errorf("expecting %d collected, got %d", 0, count)
+	}
+
+	/* Nor once it's sent or expired, as it can still be retried */
+	for _, key := range keys[1:] {
+		ds.MarkSent(key, "<sent@example.com>")
+	}
+	ds.MarkExpired(keys[0])
+	count, _ = ds.CollectAttachments(0)
+	if count != 0 {
+		t.Errorf("expecting %d collected, got %d", 0, count)
+	}
+
+	if _, err = ds.RetryMail(keys[0], time.Now()); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	m, err := ds.GetMail(keys[0])
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if m.State != UNSENT || !cmp.Equal(m.Attachments, AttachSet{syllabus}) {
+		t.Errorf("expecting the retry to keep %+v, got %s %+v", AttachSet{syllabus}, m.State, m.Attachments)
+	}
+	ds.MarkSent(keys[0], "<sent@example.com>")
+
+	/* Once the mail's purged, it's fair game, after the grace period */
+	stripped, _, err := ds.PurgeFinished(time.Now().Add(time.Hour), time.Time{})
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if stripped != 3 {
+		t.Errorf("expecting %d stripped, got %d", 3, stripped)
+	}
+	count, _ = ds.CollectAttachments(time.Hour)
+	if count != 0 {
+		t.Errorf("expecting %d collected, got %d", 0, count)
+	}
+	count, _ = ds.CollectAttachments(0)
+	if count != 1 {
+		t.Errorf("expecting %d collected, got %d", 1, count)
+	}
+}
+
+func TestAttachmentsStoredOnce(t *tt.T) {
+	ds := getDatastore(t)
+
+	a := &Attachment{
+		Content: []byte("a big pdf"),
+		Type: "application/pdf",
+		Name: "syllabus.pdf",
+	}
+	for i := 0; i < 3; i++ {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "course",
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Syllabus",
+			TextBody: "see attached",
+			Attachments: AttachSet{a},
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+
+	var count int
+	ds.Data.Get(&count, `SELECT count(*) FROM attachments`)
+	if count != 1 {
+		t.Errorf("expecting %d stored attachments, got %d", 1, count)
+	}
+
+	/* Cancelling unlinks */
+	cancelled, err := ds.CancelJob("course")
+	if err != nil || cancelled != 3 {
+		t.Errorf("expecting %d cancelled, got %d (err %v)", 3, cancelled, err)
+	}
+	ds.Data.Get(&count, `SELECT count(*) FROM mail_attachments`)
+	if count != 0 {
+		t.Errorf("expecting %d links, got %d", 0, count)
+	}
+}
+
+func testPurgeFinished(t *tt.T, ds Datastore) {
+	var keys []string
+	for i := 0; i < 3; i++ {
+		m := &Mail{
+			JobKey: "receipts",
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Your receipt",
+			HTMLBody: "<p>thanks!</p>",
+			SendAt: Timestamp(time.Now()),
+			Attachments: AttachSet{
+				&Attachment{ Content: []byte("$58"), Type: "text/plain", Name: "receipt.txt" },
+			},
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.IdemKey())
+	}
+	ds.MarkSent(keys[0], "<0@mailgun>")
+	ds.MarkSent(keys[1], "<1@mailgun>")
+
+	soon := time.Now().Add(time.Second)
+	stripped, deleted, err := ds.PurgeFinished(soon, time.Time{})
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if stripped != 2 || deleted != 0 {
+		t.Errorf("expecting 2 stripped and 0 deleted, got %d and %d", stripped, deleted)
+	}
+
+	m, err := ds.GetMail(keys[0])
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if m.ToAddr != "" || m.HTMLBody != "" || len(m.Attachments) != 0 {
+		t.Errorf("expecting contents to be gone, got %+v", m)
+	}
+	if m.Title != "Your receipt" || m.ProviderID.String != "<0@mailgun>" {
+		t.Errorf("expecting metadata to be kept, got %+v", m)
+	}
+
+	/* Unsent mail is left alone */
+	m, _ = ds.GetMail(keys[2])
+	if m.ToAddr != "2@example.com" || len(m.Attachments) != 1 {
+		t.Errorf("wasn't expecting unsent mail to change, got %+v", m)
+	}
+
+	/* Already stripped */
+	stripped, _, _ = ds.PurgeFinished(soon, time.Time{})
+	if stripped != 0 {
+		t.Errorf("expecting %d stripped, got %d", 0, stripped)
+	}
+
+	_, deleted, err = ds.PurgeFinished(time.Time{}, soon)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expecting %d deleted, got %d", 2, deleted)
+	}
+	mails, _ := ds.GetJob("receipts")
+	if len(mails) != 1 {
+		t.Errorf("expecting %d mails left, got %d", 1, len(mails))
+	}
+
+	if err = ds.Vacuum(); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+}
+
+func TestIncrementalVacuum(t *tt.T) {
+	path := filepath.Join(t.TempDir(), "mail.db")
+	ds, err := SQLiteStoreNew(path)
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+
+	/* Not switched over, so there's nothing to do */
+	if err = ds.Vacuum(); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	var mode int
+	ds.Data.Get(&mode, `PRAGMA auto_vacuum`)
+	if mode != 0 {
+		t.Errorf("expecting auto_vacuum %d, got %d", 0, mode)
+	}
+	ds.Data.Close()
+
+	mg, err := MigratorNew(path)
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	defer mg.Close()
+	for _, exp := range []bool{ true, false } {
+		switched, err := mg.EnableIncrementalVacuum()
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		if switched != exp {
+			t.Errorf("expecting switched %v, got %v", exp, switched)
+		}
+	}
+
+	/* Connections only see the switch once they're reopened */
+	if ds, err = SQLiteStoreNew(path); err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	defer ds.Data.Close()
+	ds.Data.Get(&mode, `PRAGMA auto_vacuum`)
+	if mode != 2 {
+		t.Errorf("expecting auto_vacuum %d, got %d", 2, mode)
+	}
+	if err = ds.Vacuum(); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+}
+
+func TestEncryptedAtRest(t *tt.T) {
+	ds := getDatastore(t)
+	keys, err := ParseKeyring("old:" + testKey('a'), "")
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	ds.Keys = keys
+
+	m := &Mail{
+		JobKey: "secrets",
+		ToAddr: "hi@example.com",
+		Title: "Your password",
+		HTMLBody: "<p>hunter2</p>",
+		TextBody: "hunter2",
+		SendAt: Timestamp(time.Now()),
+		Attachments: AttachSet{
+			&Attachment{ Content: []byte("hunter2"), Type: "text/plain", Name: "pw.txt" },
+		},
+	}
+	if err = ds.ScheduleMail(m); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+
+	var stored storedMail
+	err = ds.Data.Get(&stored, `SELECT html_body, text_body, key_id FROM scheduled WHERE idem_key = ?`, m.Idem)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if strings.Contains(stored.HTMLBody + stored.TextBody, "hunter2") || stored.KeyID.String != "old" {
+		t.Errorf("expecting bodies sealed under old, got %+v", stored)
+	}
+
+	got, err := ds.GetMail(m.Idem)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if got.HTMLBody != m.HTMLBody || got.TextBody != m.TextBody || string(got.Attachments[0].Content) != "hunter2" {
+		t.Errorf("expecting mail to open, got %+v", got)
+	}
+
+	/* Editing one body keeps the other readable */
+	text := "hunter3"
+	if _, err = ds.EditMail(m.Idem, &MailEdit{ TextBody: &text }); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	got, _ = ds.GetMail(m.Idem)
+	if got.HTMLBody != m.HTMLBody || got.TextBody != text {
+		t.Errorf("expecting edited mail to open, got %+v", got)
+	}
+
+	/* Providers quote addresses back in their errors */
+	bounce := "550 hi@example.com: no such user"
+	if err = ds.RescheduleFailed(m.Idem, 1, time.Now().Unix(), bounce); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	err = ds.Data.Get(&stored, `SELECT last_error, error_key_id FROM scheduled WHERE idem_key = ?`, m.Idem)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if strings.Contains(stored.LastError.String, "hi@example.com") || stored.ErrorKeyID.String != "old" {
+		t.Errorf("expecting last error sealed under old, got %+v", stored)
+	}
+
+	/* Rotate: both keys known, new mail goes under the new one */
+	ds.Keys, err = ParseKeyring("old:" + testKey('a') + ",new:" + testKey('b'), "new")
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+
+	count, err := ds.Reencrypt(100)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if count != 3 {
+		t.Errorf("expecting %d re-encrypted, got %d", 3, count)
+	}
+	if count, _ = ds.Reencrypt(100); count != 0 {
+		t.Errorf("expecting %d re-encrypted, got %d", 0, count)
+	}
+
+	/* The old key can go now */
+	ds.Keys, _ = ParseKeyring("new:" + testKey('b'), "")
+	got, err = ds.GetMail(m.Idem)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if got.TextBody != text || string(got.Attachments[0].Content) != "hunter2" || got.LastError.String != bounce {
+		t.Errorf("expecting re-encrypted mail to open, got %+v", got)
+	}
+	failures, err := ds.FailingMails(10)
+	if err != nil || len(failures) != 1 || failures[0].LastError.String != bounce {
+		t.Errorf("expecting the failure's error to open, got %+v (err %v)", failures, err)
+	}
+
+	/* Without any key it can't be read */
+	ds.Keys = nil
+	if _, err = ds.GetMail(m.Idem); err == nil {
+		t.Errorf("expecting err reading sealed mail without keys")
+	}
+}
+
+func testExportImport(t *tt.T, ds Datastore) {
+	now := time.Now()
+	var keys []string
+	for i := 0; i < 4; i++ {
+		m := &Mail{
+			JobKey: "move",
+			Missive: sql.NullString{ String: "welcome", Valid: i < 3 },
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Moving house",
+			HTMLBody: "<p>we've moved</p>",
+			SendAt: Timestamp(now.Add(time.Duration(i) * time.Hour)),
+			Priority: PriorityHigh,
+			Attachments: AttachSet{
+				&Attachment{ Content: []byte("new address"), Type: "text/plain", Name: "address.txt" },
+			},
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.Idem)
+	}
+	ds.MarkSent(keys[0], "<0@mailgun>")
+	ds.RescheduleFailed(keys[1], 2, time.Time(now).Unix(), "try again")
+
+	var out bytes.Buffer
+	exported, skipped, err := ExportMails(ds, &MailFilter{ Missive: "welcome" }, &out)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if exported != 3 || skipped != 0 {
+		t.Errorf("expecting 3 exported and 0 skipped, got %d and %d", exported, skipped)
+	}
+
+	/* Date ranges are on send_at */
+	var ranged bytes.Buffer
+	exported, _, _ = ExportMails(ds, &MailFilter{ SendFrom: now.Add(30 * time.Minute), SendTo: now.Add(210 * time.Minute) }, &ranged)
+	if exported != 2 {
+		t.Errorf("expecting %d exported, got %d", 2, exported)
+	}
+
+	into := MemStoreNew()
+	imported, skipped, err := ImportMails(into, bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if imported != 3 || skipped != 0 {
+		t.Errorf("expecting 3 imported and 0 skipped, got %d and %d", imported, skipped)
+	}
+
+	for _, key := range keys[:3] {
+		want, _ := ds.GetMail(key)
+		got, err := into.GetMail(key)
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+			continue
+		}
+		if got.State != want.State || got.TryCount != want.TryCount || got.ProviderID != want.ProviderID {
+			t.Errorf("expecting state %s (x%d, %s), got %s (x%d, %s)", want.State, want.TryCount, want.ProviderID.String, got.State, got.TryCount, got.ProviderID.String)
+		}
+		if got.Missive != want.Missive || got.Priority != want.Priority || got.HTMLBody != want.HTMLBody || time.Time(got.SendAt).Unix() != time.Time(want.SendAt).Unix() {
+			t.Errorf("was expecting %+v, got %+v", want, got)
+		}
+		if !cmp.Equal(got.Attachments, want.Attachments) {
+			t.Errorf("was expecting %+v, got %+v", want.Attachments, got.Attachments)
+		}
+	}
+
+	/* Running it again doesn't double up */
+	imported, skipped, _ = ImportMails(into, bytes.NewReader(out.Bytes()))
+	if imported != 0 || skipped != 3 {
+		t.Errorf("expecting 0 imported and 3 skipped, got %d and %d", imported, skipped)
+	}
+
+	_, _, err = ImportMails(into, bytes.NewReader([]byte(`{"idempotency_key": "x", "state": "lost", "text_body": "hi"}`)))
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+}
+
+func testQueueStats(t *tt.T, ds Datastore) {
+	now := time.Now()
+	for i, at := range []time.Time{ now.Add(-2 * time.Hour), now.Add(-time.Hour), now.Add(time.Hour) } {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "stats",
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Counting",
+			TextBody: "one, two",
+			SendAt: Timestamp(at),
+			Domain: "base58.school",
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+	ds.ScheduleMail(&Mail{
+		JobKey: "stats",
+		ToAddr: "other@example.com",
+		Title: "Counting",
+		TextBody: "three",
+		SendAt: Timestamp(now.Add(-3 * time.Hour)),
+		Domain: "example.com",
+	})
+	ds.Pause(PauseJob, "nothing")
+
+	/* Claimed mail is on its way, so isn't waiting */
+	mails, _ := ds.GetToSendBatch(now, 1, "worker", time.Minute)
+	if len(mails) != 1 {
+		t.Errorf("expecting %d claimed, got %d", 1, len(mails))
+	}
+
+	stats, err := ds.QueueStats(now)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if stats.Due != 2 {
+		t.Errorf("expecting %d due, got %d", 2, stats.Due)
+	}
+	if stats.OldestDue.Unix() != now.Add(-2 * time.Hour).Unix() {
+		t.Errorf("expecting oldest due %s, got %s", now.Add(-2 * time.Hour), stats.OldestDue)
+	}
+
+	expected := []QueueCount{
+		{ State: INPROG, Domain: "example.com", Count: 1 },
+		{ State: UNSENT, Domain: "base58.school", Count: 3 },
+	}
+	if !cmp.Equal(stats.Counts, expected) {
+		t.Errorf("was expecting %+v, got %+v", expected, stats.Counts)
+	}
+}
+
+func testRetryCancel(t *tt.T, ds Datastore) {
+	now := time.Now()
+	var keys []string
+	for i := 0; i < 3; i++ {
+		m := &Mail{
+			JobKey: "retry",
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Hello",
+			TextBody: "hi",
+			SendAt: Timestamp(now.Add(-time.Hour)),
+			ExpiresAt: sql.NullInt64{ Int64: now.Add(time.Hour).Unix(), Valid: true },
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.IdemKey())
+	}
+
+	ds.RescheduleFailed(keys[0], 20, now.Unix(), "554 rejected")
+	ds.MarkExpired(keys[1])
+
+	m, _ := ds.GetMail(keys[0])
+	if m.LastError.String != "554 rejected" {
+		t.Errorf("expecting last error %s, got %s", "554 rejected", m.LastError.String)
+	}
+
+	/* Only failed or expired mail is retried */
+	for i, want := range []int64{1, 1, 0} {
+		count, err := ds.RetryMail(keys[i], now)
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		if count != want {
+			t.Errorf("expecting %d retried for mail %d, got %d", want, i, count)
+		}
+	}
+
+	for _, key := range keys[:2] {
+		m, _ := ds.GetMail(key)
+		if m.State != UNSENT || m.TryCount != 0 || m.ExpiresAt.Valid {
+			t.Errorf("expecting %s with no tries or deadline, got %s (x%d, %v)", UNSENT, m.State, m.TryCount, m.ExpiresAt)
+		}
+	}
+
+	ds.MarkSent(keys[2], "<2@mailgun>")
+	for i, want := range []int64{1, 1, 0} {
+		count, err := ds.CancelMail(keys[i])
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		if count != want {
+			t.Errorf("expecting %d cancelled for mail %d, got %d", want, i, count)
+		}
+	}
+	if _, err := ds.GetMail(keys[0]); err == nil {
+		t.Errorf("expecting cancelled mail to be gone")
+	}
+}
+
+func testAudit(t *tt.T, ds Datastore) {
+	base := time.Now().Add(-time.Hour)
+	for i, action := range []string{"schedule", "schedule", "cancel", "pause"} {
+		entry := &AuditEntry{
+			At: base.Add(time.Duration(i) * time.Minute).Unix(),
+			Client: "ops",
+			RemoteAddr: "10.0.0.1:1234",
+			Action: action,
+			Target: "job_key",
+			Key: "course-" + strconv.Itoa(i % 2),
+			Count: int64(i),
+		}
+		if err := ds.RecordAudit(entry); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		if entry.ID == 0 {
+			t.Errorf("expecting the entry to get an id")
+		}
+	}
+
+	/* Newest first */
+	entries, err := ds.FindAudit(&AuditFilter{}, 0, 3)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(entries) != 3 || entries[0].Action != "pause" || entries[2].Action != "schedule" {
+		t.Fatalf("expecting the 3 latest entries, newest first, got %v", entries)
+	}
+
+	/* And the page after */
+	entries, _ = ds.FindAudit(&AuditFilter{}, entries[2].ID, 3)
+	if len(entries) != 1 || entries[0].Count != 0 {
+		t.Errorf("expecting the first entry, got %v", entries)
+	}
+
+	entries, _ = ds.FindAudit(&AuditFilter{ Action: "schedule", Key: "course-1" }, 0, 10)
+	if len(entries) != 1 || entries[0].Count != 1 || entries[0].RemoteAddr != "10.0.0.1:1234" {
+		t.Errorf("expecting the one matching entry, got %v", entries)
+	}
+
+	entries, _ = ds.FindAudit(&AuditFilter{ Since: base.Add(time.Minute), Until: base.Add(3 * time.Minute) }, 0, 10)
+	if len(entries) != 2 {
+		t.Errorf("expecting %d entries in range, got %d", 2, len(entries))
+	}
+}
+
+func TestAuditAppendOnly(t *tt.T) {
+	ds := getDatastore(t)
+	ds.RecordAudit(&AuditEntry{ Action: "schedule", Target: "idem_key", Key: "abc" })
+
+	if _, err := ds.Data.Exec(`UPDATE audit_log SET client = 'someone else'`); err == nil {
+		t.Errorf("expecting audit entries to be unchangeable")
+	}
+	if _, err := ds.Data.Exec(`DELETE FROM audit_log`); err == nil {
+		t.Errorf("expecting audit entries to be undeletable")
+	}
+}
+
+func testScheduleReplay(t *tt.T, ds Datastore) {
+	req := MailRequest{
+		IdempotencyKey: "welcome",
+		JobKey: "course",
+		ToAddr: "hi@example.com",
+		Title: "Welcome",
+		TextBody: "hi",
+		Attachments: AttachSet([]*Attachment{
+			&Attachment{ Content: []byte("a,b"), Type: "text/csv", Name: "data.csv" },
+		}),
+		SendAt: 1680358878,
+	}
+	convert := func(req MailRequest) *Mail {
+		m, err := ConvertMailRequest(req)
+		if err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		return m
+	}
+
+	orig := req
+	first := convert(req)
+	if replayed, err := ScheduleRequest(ds, first); err != nil || replayed {
+		t.Fatalf("expecting a new mail, got %v (replayed %v)", err, replayed)
+	}
+
+	/* The client never heard back, so sends it again */
+	again := convert(req)
+	replayed, err := ScheduleRequest(ds, again)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if !replayed || again.IdemKey() != first.IdemKey() {
+		t.Errorf("expecting a replay of %s, got %s (replayed %v)", first.IdemKey(), again.IdemKey(), replayed)
+	}
+
+	/* Same key, different mail */
+	req.TextBody = "hello"
+	if _, err = ScheduleRequest(ds, convert(req)); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	/* Another job can use the same key */
+	req.JobKey = "other-course"
+	other := convert(req)
+	if replayed, err = ScheduleRequest(ds, other); err != nil || replayed {
+		t.Errorf("expecting a new mail, got %v (replayed %v)", err, replayed)
+	}
+	if other.IdemKey() == first.IdemKey() {
+		t.Errorf("wasn't expecting jobs to share key %s", first.IdemKey())
+	}
+
+	/* Editing the mail doesn't make a replay a conflict */
+	text := "edited"
+	if _, err = ds.EditMail(first.IdemKey(), &MailEdit{ TextBody: &text }); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if replayed, err = ScheduleRequest(ds, convert(orig)); err != nil || !replayed {
+		t.Errorf("expecting a replay, got %v (replayed %v)", err, replayed)
+	}
+	checkMailState(t, ds, UNSENT, 2)
+}
+
+func testDashboardCounts(t *tt.T, ds Datastore) {
+	now := time.Now().Truncate(time.Second)
+	week1 := sql.NullString{ String: "week-1", Valid: true }
+	for i, at := range []time.Duration{ time.Hour, time.Hour, 2 * time.Hour, 30 * 24 * time.Hour } {
+		err := ds.ScheduleMail(&Mail{
+			JobKey: "course",
+			Missive: week1,
+			ToAddr: strconv.Itoa(i) + "@example.com",
+			Title: "Week 1",
+			TextBody: "hello",
+			SendAt: Timestamp(now.Add(at)),
+		})
+		if err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+	failing := &Mail{
+		JobKey: "announce",
+		ToAddr: "bounce@example.com",
+		Title: "News",
+		HTMLBody: "<p>news</p>",
+		SendAt: Timestamp(now),
+	}
+	if err := ds.ScheduleMail(failing); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	ds.RescheduleFailed(failing.IdemKey(), 1, now.Add(time.Minute).Unix(), "mailbox unavailable")
+
+	counts, err := ds.CountByJob()
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	exp := []MailCount{
+		{ JobKey: "announce", State: FAILED, Count: 1 },
+		{ JobKey: "course", Missive: week1, State: UNSENT, Count: 4 },
+	}
+	if len(counts) != len(exp) {
+		t.Fatalf("expecting %d counts, got %d", len(exp), len(counts))
+	}
+	for i, c := range counts {
+		if *c != exp[i] {
+			t.Errorf("expecting %+v, got %+v", exp[i], *c)
+		}
+	}
+
+	/* Two weeks out, and only the first two send times of it */
+	waiting, err := ds.CountWaiting(now.AddDate(0, 0, 14), 2)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	exp = []MailCount{
+		{ JobKey: "announce", SendAt: now.Add(time.Minute).Unix(), Count: 1 },
+		{ JobKey: "course", SendAt: now.Add(time.Hour).Unix(), Count: 2 },
+	}
+	if len(waiting) != len(exp) {
+		t.Fatalf("expecting %d counts, got %d", len(exp), len(waiting))
+	}
+	for i, c := range waiting {
+		if *c != exp[i] {
+			t.Errorf("expecting %+v, got %+v", exp[i], *c)
+		}
+	}
+
+	failures, err := ds.FailingMails(50)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(failures) != 1 || failures[0].IdemKey() != failing.IdemKey() {
+		t.Fatalf("expecting %s to be failing, got %+v", failing.IdemKey(), failures)
+	}
+	if f := failures[0]; f.HTMLBody != "" || f.LastError.String != "mailbox unavailable" || f.TryCount != 1 {
+		t.Errorf("expecting the failure without its body, got %+v", f)
+	}
+}
@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+/* Write every mail matching filter to w, one MailExport per line.
+ * Mail whose contents have been purged can't be sent again, so it's
+ * left out; skipped says how many were. */
+func ExportMails(ds Datastore, filter *MailFilter, w io.Writer) (exported int, skipped int, err error) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	/* A page at a time, attachments and all, so keep them small */
+	after := ""
+	for {
+		mails, err := ds.FindMails(filter, after, 100)
+		if err != nil {
+			return exported, skipped, err
+		}
+		if len(mails) == 0 {
+			return exported, skipped, nil
+		}
+
+		for _, m := range mails {
+			if m.HTMLBody == "" && m.TextBody == "" {
+				skipped++
+				continue
+			}
+			if err = encoder.Encode(ExportMail(m)); err != nil {
+				return exported, skipped, err
+			}
+			exported++
+		}
+		after = mails[len(mails) - 1].Idem
+	}
+}
+
+/* Read mails written by ExportMails back in, keeping their idem keys
+ * and states. Mail we already have is skipped, so an import that
+ * stopped partway can be run again. */
+func ImportMails(ds Datastore, r io.Reader) (imported int, skipped int, err error) {
+	decoder := json.NewDecoder(r)
+
+	for line := 1; ; line++ {
+		var e MailExport
+		err = decoder.Decode(&e)
+		if err == io.EOF {
+			return imported, skipped, nil
+		}
+		if err != nil {
+			return imported, skipped, fmt.Errorf("mail %d: %s", line, err)
+		}
+
+		m, err := ConvertMailExport(e)
+		if err != nil {
+			return imported, skipped, fmt.Errorf("mail %d: %s", line, err)
+		}
+
+		_, err = ds.GetMail(m.Idem)
+		if err == nil {
+			skipped++
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return imported, skipped, err
+		}
+
+		if err = ds.ImportMail(m); err != nil {
+			return imported, skipped, fmt.Errorf("mail %d: %s", line, err)
+		}
+		imported++
+	}
+}
@@ -2,15 +2,32 @@ package mail
 
 import (
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"github.com/gorilla/mux"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
+func returnAudit(w http.ResponseWriter, entries []*AuditEntry, next int64) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ReturnVal{
+		Success: true,
+		Code: http.StatusOK,
+		Audit: entries,
+		Next: next,
+	})
+}
+
 func returnErr(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(&ReturnVal{
@@ -29,7 +46,41 @@ func returnSuccess(w http.ResponseWriter) {
 	})
 }
 
-func checkKey(secret string, r *http.Request) error {
+func returnCount(w http.ResponseWriter, count int64) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ReturnVal{
+		Success: true,
+		Code: http.StatusOK,
+		Count: count,
+	})
+}
+
+func returnIdemKey(w http.ResponseWriter, idemKey string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ReturnVal{
+		Success: true,
+		Code: http.StatusOK,
+		IdemKey: idemKey,
+	})
+}
+
+func returnHash(w http.ResponseWriter, hash string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ReturnVal{
+		Success: true,
+		Code: http.StatusOK,
+		Hash: hash,
+	})
+}
+
+func checkKey(secret string, r *http.Request) (err error) {
+	defer func() {
+		if err != nil {
+			authFailures.Inc(routeName(r))
+			slog.Warn("Not auth'd", "route", routeName(r), "method", r.Method, "reason", err)
+		}
+	}()
+
 	/* Expect a header: Authorization: xxx */
 	authToken := r.Header.Get("Authorization")
 	timestamp := r.Header.Get("X-Base58-Timestamp")
@@ -49,36 +100,36 @@ func checkKey(secret string, r *http.Request) error {
 		return fmt.Errorf("Invalid timestamp")
 	}
 
+	/* The client's name goes in the audit log, so it's signed too.
+	 * Without one this is the token it's always been */
 	h := sha256.New()
 	h.Write([]byte(secret))
 	h.Write([]byte(timestamp))
 	h.Write([]byte(r.URL.Path))
 	h.Write([]byte(r.Method))
+	h.Write([]byte(clientName(r)))
 	expToken := hex.EncodeToString(h.Sum(nil))
 
 	if authToken != expToken {
-		fmt.Println("inputs:", timestamp, r.URL.Path, r.Method)
-		fmt.Printf("expected %s, got %s", expToken, authToken)
 		return fmt.Errorf("Invalid auth token")
 	}
 	return nil
 }
 
-func HandleMailJob(w http.ResponseWriter, r *http.Request, ds *Datastore, secret string) {
+func HandleMailJob(w http.ResponseWriter, r *http.Request, ds Datastore, secret string, policy *AttachmentPolicy, waker *Waker) {
 	err := checkKey(secret, r)
 	if err != nil {
-		fmt.Printf("Not auth'd")
 		returnErr(w, err)
 		return
 	}
 
 	/* Pull the data out of the request body */
 	var job MailRequest
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&job)
+	limitBody(w, r, policy)
+	err = decodeMailRequest(r, &job, policy)
 
 	if err != nil {
-		fmt.Printf("Unable to decode request: %s\n", err)
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
 		returnErr(w, err)
 		return
 	}
@@ -86,28 +137,184 @@ func HandleMailJob(w http.ResponseWriter, r *http.Request, ds *Datastore, secret
 	/* Convert to Mail */
 	m, err := ConvertMailRequest(job)
 	if err != nil {
-		fmt.Printf("Unable to convert mail job: %s\n", err)
+		slog.Warn("Unable to convert mail job", "err", err)
+		returnErr(w, err)
+		return
+	}
+	if err = CheckRequest(ds, policy, m); err != nil {
+		slog.Warn("Mail breaks the attachment policy", "err", err)
 		returnErr(w, err)
 		return
 	}
 
 	/* Save Job */
-	err = ds.ScheduleMail(m)
+	replayed, err := ScheduleRequest(ds, m)
 	if err != nil {
-		fmt.Printf("Unable to schedule mail: %s\n", err)
+		slog.Error("Unable to schedule mail", append(MailAttrs(m), "err", err)...)
 		returnErr(w, err)
 		return
 	}
+	if replayed {
+		slog.Info("Mail already scheduled", MailAttrs(m)...)
+		returnIdemKey(w, m.IdemKey())
+		return
+	}
+
+	/* Let the worker know, in case it's due before its next poll */
+	waker.Wake()
 
 	/* Send a success */
-	fmt.Printf("Scheduled new mail item for job %s %s\n", m.JobKey, m.IdemKey())
-	returnSuccess(w)
+	slog.Info("Scheduled mail", append(MailAttrs(m), "send_at", m.SendAt)...)
+	audit(ds, r, clientName(r), "schedule", string(PauseMail), m.IdemKey(), 1)
+	returnIdemKey(w, m.IdemKey())
 }
 
-func DeleteMailJob(w http.ResponseWriter, r *http.Request, ds *Datastore, secret string) {
+/* Schedule a new mail. Sending the same request again, as a client
+ * that never heard back would, isn't an error: the mail's scheduled
+ * already, under the same key. Reusing a key for a different mail is */
+func ScheduleRequest(ds Datastore, m *Mail) (replayed bool, err error) {
+	err = ds.ScheduleMail(m)
+	if !errors.Is(err, ErrAlreadyScheduled) {
+		return false, err
+	}
+
+	stored, getErr := ds.GetMail(m.IdemKey())
+	if getErr != nil || !stored.SameRequest(m) {
+		return false, fmt.Errorf("Idempotency key %s is already used by a different mail", m.IdemKey())
+	}
+	m.Idem = stored.Idem
+	return true, nil
+}
+
+/* Don't read more of a body than the biggest mail we'd take */
+func limitBody(w http.ResponseWriter, r *http.Request, policy *AttachmentPolicy) {
+	if max := policy.MaxRequestBytes(); max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+}
+
+/* A MailRequest is JSON or, to send attachments as they are, is
+ * multipart/form-data: the JSON in a part named "request" and each
+ * file in a part of its own. The files are attached after any in the
+ * JSON, in the order they came. Between them, they're held to what
+ * fits in a message under p */
+func decodeMailRequest(r *http.Request, job *MailRequest, p *AttachmentPolicy) error {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		return DecodeMailRequest(data, job, p)
+	}
+
+	budget := p.attachBudget()
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	var files AttachSet
+	found := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case part.FormName() == "request":
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			if err = decodeMailRequestJSON(data, job, budget); err != nil {
+				return err
+			}
+			found = true
+		case part.FileName() != "":
+			/* Count them, and what they come to, before reading them in */
+			if len(files) == maxAttachments {
+				return fmt.Errorf("Too many attachments, limit %d", maxAttachments)
+			}
+			content, err := io.ReadAll(io.LimitReader(part, min(budget.left, maxAttachmentTLV) + 1))
+			if err != nil {
+				return err
+			}
+			if len(content) > maxAttachmentTLV {
+				return fmt.Errorf("Attachment %s is more than %d bytes", part.FileName(), maxAttachmentTLV)
+			}
+			if err = budget.take(int64(len(content))); err != nil {
+				return err
+			}
+			/* Clients say octet-stream when they don't know */
+			typ := part.Header.Get("Content-Type")
+			if typ == "" || typ == "application/octet-stream" {
+				typ = SniffType(part.FileName(), content)
+			}
+			files = append(files, &Attachment{
+				Name: part.FileName(),
+				Type: typ,
+				Content: content,
+			})
+		default:
+			return fmt.Errorf("Unexpected form field %s; files need a filename", part.FormName())
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("Missing request part")
+	}
+	if count := len(job.Attachments) + len(files); count > maxAttachments {
+		return fmt.Errorf("Too many attachments: %d, limit %d", count, maxAttachments)
+	}
+	job.Attachments = append(job.Attachments, files...)
+	return nil
+}
+
+/* Upload an attachment ahead of time. The hash that comes back can be
+ * put in a MailRequest's attachment_refs as many times as you like */
+func UploadAttachment(w http.ResponseWriter, r *http.Request, ds Datastore, secret string, policy *AttachmentPolicy) {
+	err := checkKey(secret, r)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+
+	var upload AttachmentUpload
+	limitBody(w, r, policy)
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&upload)
+
+	if err != nil {
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
+		returnErr(w, err)
+		return
+	}
+	if upload.Attachment == nil {
+		returnErr(w, fmt.Errorf("Missing attachment"))
+		return
+	}
+	if err = policy.CheckAttachments(AttachSet{ upload.Attachment }); err != nil {
+		slog.Warn("Refused attachment", "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	hash, err := ds.PutAttachment(upload.Attachment)
+	if err != nil {
+		slog.Error("Unable to save attachment", "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	slog.Info("Saved attachment", "hash", hash)
+	audit(ds, r, clientName(r), "upload", "hash", hash, 1)
+	returnHash(w, hash)
+}
+
+func DeleteMailJob(w http.ResponseWriter, r *http.Request, ds Datastore, secret string) {
 	err := checkKey(secret, r)
 	if err != nil {
-		fmt.Printf("Not auth'd")
 		returnErr(w, err)
 		return
 	}
@@ -117,20 +324,24 @@ func DeleteMailJob(w http.ResponseWriter, r *http.Request, ds *Datastore, secret
 	err = decoder.Decode(&job)
 
 	if err != nil {
-		fmt.Printf("Unable to decode request: %s\n", err)
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
 		returnErr(w, err)
 		return
 	}
-	ds.DeleteJob(job.JobKey)
-	fmt.Printf("Deleted job %s\n", job.JobKey)
-	/* FIXME: notify if none? */
-	returnSuccess(w)
+	count, err := ds.DeleteJob(job.JobKey)
+	if err != nil {
+		slog.Error("Unable to delete mail", "job_key", job.JobKey, "err", err)
+		returnErr(w, err)
+		return
+	}
+	slog.Info("Deleted job", "job_key", job.JobKey, "count", count)
+	audit(ds, r, clientName(r), "cancel", string(PauseJob), job.JobKey, count)
+	returnCount(w, count)
 }
 
-func DeleteMissive(w http.ResponseWriter, r *http.Request, ds *Datastore, secret string) {
+func DeleteMissive(w http.ResponseWriter, r *http.Request, ds Datastore, secret string) {
 	err := checkKey(secret, r)
 	if err != nil {
-		fmt.Printf("Not auth'd")
 		returnErr(w, err)
 		return
 	}
@@ -140,20 +351,24 @@ func DeleteMissive(w http.ResponseWriter, r *http.Request, ds *Datastore, secret
 	err = decoder.Decode(&missive)
 
 	if err != nil {
-		fmt.Printf("Unable to decode request: %s\n", err)
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
 		returnErr(w, err)
 		return
 	}
-	ds.CancelMissive(missive.Missive)
-	fmt.Printf("Deleted missive %s\n", missive.Missive)
-	/* FIXME: notify if none? */
-	returnSuccess(w)
+	count, err := ds.CancelMissive(missive.Missive)
+	if err != nil {
+		slog.Error("Unable to delete mail", "missive", missive.Missive, "err", err)
+		returnErr(w, err)
+		return
+	}
+	slog.Info("Deleted missive", "missive", missive.Missive, "count", count)
+	audit(ds, r, clientName(r), "cancel", string(PauseMissive), missive.Missive, count)
+	returnCount(w, count)
 }
 
-func DeleteSubJob(w http.ResponseWriter, r *http.Request, ds *Datastore, secret string) {
+func DeleteSubJob(w http.ResponseWriter, r *http.Request, ds Datastore, secret string) {
 	err := checkKey(secret, r)
 	if err != nil {
-		fmt.Printf("Not auth'd")
 		returnErr(w, err)
 		return
 	}
@@ -163,27 +378,397 @@ func DeleteSubJob(w http.ResponseWriter, r *http.Request, ds *Datastore, secret
 	err = decoder.Decode(&sub)
 
 	if err != nil {
-		fmt.Printf("Unable to decode request: %s\n", err)
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
+		returnErr(w, err)
+		return
+	}
+	count, err := ds.DeleteSubscription(sub.SubKey)
+	if err != nil {
+		slog.Error("Unable to delete mail", "subscription", sub.SubKey, "err", err)
+		returnErr(w, err)
+		return
+	}
+	slog.Info("Deleted subscription", "subscription", sub.SubKey, "count", count)
+	audit(ds, r, clientName(r), "cancel", string(PauseSubscription), sub.SubKey, count)
+	returnCount(w, count)
+}
+
+func PauseMails(w http.ResponseWriter, r *http.Request, ds Datastore, secret string, target PauseTarget, pause bool, waker *Waker) {
+	err := checkKey(secret, r)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+
+	var req PauseRequest
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&req)
+
+	if err != nil {
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	var key string
+	switch target {
+	case PauseJob:
+		key = req.JobKey
+	case PauseSubscription:
+		key = req.SubKey
+	case PauseMissive:
+		key = req.Missive
+	}
+	if key == "" {
+		returnErr(w, fmt.Errorf("Missing key to pause by"))
+		return
+	}
+
+	var count int64
+	if pause {
+		count, err = ds.Pause(target, key)
+	} else {
+		count, err = ds.Resume(target, key)
+	}
+	if err != nil {
+		slog.Error("Unable to update mails", "target", target, "key", key, "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	if pause {
+		slog.Info("Paused mails", "target", target, "key", key, "count", count)
+	} else {
+		slog.Info("Resumed mails", "target", target, "key", key, "count", count)
+		waker.Wake()
+	}
+	audit(ds, r, clientName(r), pauseAction(pause), string(target), key, count)
+	returnCount(w, count)
+}
+
+/* Flip the global kill switch. The API stays up, but no
+ * worker will claim mail until it's switched back */
+func PauseAll(w http.ResponseWriter, r *http.Request, ds Datastore, secret string, pause bool, waker *Waker) {
+	err := checkKey(secret, r)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+
+	if err = ds.SetPaused(pause); err != nil {
+		slog.Error("Unable to set the kill switch", "paused", pause, "err", err)
 		returnErr(w, err)
 		return
 	}
-	ds.DeleteSubscription(sub.SubKey)
-	fmt.Printf("Deleted subscription %s\n", sub.SubKey)
-	/* FIXME: notify if none? */
+
+	slog.Info("Kill switch flipped", "paused", pause)
+	audit(ds, r, clientName(r), pauseAction(pause) + "_all", "", "", 0)
+	if !pause {
+		waker.Wake()
+	}
 	returnSuccess(w)
 }
 
-func SetupRoutes(ds *Datastore, secret string) http.Handler {
+/* PATCH the content of one mail (by idem key) or every
+ * mail in a missive, for whatever hasn't gone out yet */
+func EditMails(w http.ResponseWriter, r *http.Request, ds Datastore, secret string, policy *AttachmentPolicy) {
+	err := checkKey(secret, r)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+
+	var edit MailEdit
+	limitBody(w, r, policy)
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&edit)
+
+	if err != nil {
+		slog.Warn("Unable to decode request", "route", routeName(r), "err", err)
+		returnErr(w, err)
+		return
+	}
+	if edit.Attachments != nil {
+		if err = policy.CheckAttachments(*edit.Attachments); err != nil {
+			slog.Warn("Refused attachments", "err", err)
+			returnErr(w, err)
+			return
+		}
+	}
+
+	if edit.Title != nil && *edit.Title == "" {
+		returnErr(w, fmt.Errorf("title can't be blank"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err = checkEdit(ds, policy, &edit, vars["idem_key"], vars["missive"]); err != nil {
+		slog.Warn("Edit breaks the attachment policy", "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	var count int64
+	target, key := PauseMail, vars["idem_key"]
+	log := slog.With("idem_key", key)
+	if missive, ok := vars["missive"]; ok {
+		target, key = PauseMissive, missive
+		log = slog.With("missive", missive)
+		count, err = ds.EditMissive(missive, &edit)
+	} else {
+		count, err = ds.EditMail(vars["idem_key"], &edit)
+		if err == nil && count == 0 {
+			err = fmt.Errorf("No unsent mail for %s", vars["idem_key"])
+		}
+	}
+	if err != nil {
+		log.Error("Unable to edit mail", "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	log.Info("Edited mails", "count", count)
+	audit(ds, r, clientName(r), "edit", string(target), key, count)
+	returnCount(w, count)
+}
+
+/* Hold the mails an edit would change to the policy, as they'd be
+ * after it. Attachments they keep were checked when they came in, so
+ * like uploaded ones they're checked as they are */
+func checkEdit(ds Datastore, policy *AttachmentPolicy, edit *MailEdit, idemKey string, missive string) error {
+	var refs AttachSet
+	if edit.AttachmentRefs != nil {
+		var err error
+		if refs, err = ds.GetAttachments(*edit.AttachmentRefs); err != nil {
+			return err
+		}
+	}
+
+	check := func(m *Mail) error {
+		if m.State != UNSENT && m.State != FAILED && m.State != PAUSED {
+			return nil
+		}
+
+		edited := &Mail{ HTMLBody: m.HTMLBody, TextBody: m.TextBody }
+		if edit.HTMLBody != nil {
+			edited.HTMLBody = *edit.HTMLBody
+		}
+		if edit.TextBody != nil {
+			edited.TextBody = *edit.TextBody
+		}
+
+		kept := m.Attachments
+		if edit.Attachments != nil || edit.AttachmentRefs != nil {
+			kept = refs
+			if edit.Attachments != nil {
+				edited.Attachments = *edit.Attachments
+			}
+		}
+		if err := policy.CheckMail(edited, kept); err != nil {
+			return fmt.Errorf("%s: %s", m.IdemKey(), err)
+		}
+		return nil
+	}
+
+	if missive == "" {
+		m, err := ds.GetMail(idemKey)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return check(m)
+	}
+
+	for _, state := range []ScheduleState{ UNSENT, FAILED, PAUSED } {
+		after := ""
+		for {
+			mails, err := ds.FindMails(&MailFilter{ State: state, Missive: missive }, after, 500)
+			if err != nil {
+				return err
+			}
+			for _, m := range mails {
+				if err = check(m); err != nil {
+					return err
+				}
+			}
+			if len(mails) < 500 {
+				break
+			}
+			after = mails[len(mails) - 1].IdemKey()
+		}
+	}
+	return nil
+}
+
+/* Who's asking, by their own (signed) account */
+func clientName(r *http.Request) string {
+	return r.Header.Get("X-Base58-Client")
+}
+
+func pauseAction(pause bool) string {
+	if pause {
+		return "pause"
+	}
+	return "resume"
+}
+
+/* Note a change in the audit log. It's been made by the time we get
+ * here, so if it can't be noted that's logged rather than returned */
+func Audit(ds Datastore, client string, remoteAddr string, action string, target string, key string, count int64) {
+	entry := &AuditEntry{
+		At: time.Now().UTC().Unix(),
+		Client: client,
+		RemoteAddr: remoteAddr,
+		Action: action,
+		Target: target,
+		Key: key,
+		Count: count,
+	}
+	if err := ds.RecordAudit(entry); err != nil {
+		slog.Error("Unable to record audit entry", "action", action, "target", target, "key", key, "err", err)
+	}
+}
+
+func audit(ds Datastore, r *http.Request, client string, action string, target string, key string, count int64) {
+	Audit(ds, client, r.RemoteAddr, action, target, key, count)
+}
+
+/* Page back through the audit log, newest first. Query parameters
+ * client, action and key filter it; since and until (UNIX times)
+ * bound it; before and limit page through it */
+func GetAudit(w http.ResponseWriter, r *http.Request, ds Datastore, secret string) {
+	err := checkKey(secret, r)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := &AuditFilter{
+		Client: q.Get("client"),
+		Action: q.Get("action"),
+		Key: q.Get("key"),
+	}
+
+	var before int64
+	limit := 100
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			returnErr(w, fmt.Errorf("before: %s", err))
+			return
+		}
+	}
+	for name, dest := range map[string]*time.Time{ "since": &filter.Since, "until": &filter.Until } {
+		if v := q.Get(name); v != "" {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				returnErr(w, fmt.Errorf("%s: %s", name, err))
+				return
+			}
+			*dest = time.Unix(secs, 0)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+			returnErr(w, fmt.Errorf("limit must be 1 to 1000"))
+			return
+		}
+	}
+
+	entries, err := ds.FindAudit(filter, before, limit)
+	if err != nil {
+		slog.Error("Unable to read audit log", "err", err)
+		returnErr(w, err)
+		return
+	}
+
+	var next int64
+	if len(entries) == limit {
+		next = entries[len(entries) - 1].ID
+	}
+	returnAudit(w, entries, next)
+}
+
+/* Download a consistent snapshot of the database; ?gzip=1 to
+ * have it gzipped */
+func GetBackup(w http.ResponseWriter, r *http.Request, ds Datastore, secret string) {
+	err := checkKey(secret, r)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+
+	bk, ok := ds.(Backuper)
+	if !ok {
+		returnErr(w, fmt.Errorf("Backups need the SQLite datastore"))
+		return
+	}
+
+	gzipped := r.URL.Query().Get("gzip") == "1"
+	bw := &backupWriter{ w: w, name: fmt.Sprintf("mailer-%s.db", time.Now().UTC().Format("20060102T150405Z")) }
+	if gzipped {
+		bw.name += ".gz"
+	}
+
+	/* Nothing's written until the snapshot is taken, so an error
+	 * there can still go back as JSON. Once the backup's on its way,
+	 * JSON on the end would only corrupt it, so we hang up instead */
+	if err = bk.Backup(bw, gzipped); err != nil {
+		if bw.written > 0 {
+			slog.Error("Backup cut off partway", "name", bw.name, "sent", bw.written, "err", err)
+			panic(http.ErrAbortHandler)
+		}
+		slog.Error("Unable to back up database", "err", err)
+		returnErr(w, err)
+		return
+	}
+	slog.Info("Sent backup", "name", bw.name, "sent", bw.written)
+}
+
+/* Sends the backup's headers with its first bytes, and keeps count */
+type backupWriter struct {
+	w http.ResponseWriter
+	name string
+	written int64
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	if bw.written == 0 {
+		contentType := "application/vnd.sqlite3"
+		if strings.HasSuffix(bw.name, ".gz") {
+			contentType = "application/gzip"
+		}
+		bw.w.Header().Set("Content-Type", contentType)
+		bw.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, bw.name))
+	}
+	n, err := bw.w.Write(p)
+	bw.written += int64(n)
+	return n, err
+}
+
+/* A nil policy is the default one */
+func SetupRoutes(ds Datastore, secret string, metricsToken string, policy *AttachmentPolicy, waker *Waker, health *WorkerHealth, dash *Dashboard) http.Handler {
+	if policy == nil {
+		policy = DefaultAttachmentPolicy()
+	}
+
 	r := mux.NewRouter()
+	r.Use(instrument)
 
 	r.HandleFunc("/job", func (w http.ResponseWriter, r *http.Request) {
-		HandleMailJob(w, r, ds, secret)
+		HandleMailJob(w, r, ds, secret, policy, waker)
 	}).Methods("PUT")
 
 	r.HandleFunc("/job", func (w http.ResponseWriter, r *http.Request) {
 		DeleteMailJob(w, r, ds, secret)
 	}).Methods("DELETE")
 
+	r.HandleFunc("/attachment", func (w http.ResponseWriter, r *http.Request) {
+		UploadAttachment(w, r, ds, secret, policy)
+	}).Methods("PUT")
+
 	r.HandleFunc("/sub", func (w http.ResponseWriter, r *http.Request) {
 		DeleteSubJob(w, r, ds, secret)
 	}).Methods("DELETE")
@@ -192,5 +777,58 @@ func SetupRoutes(ds *Datastore, secret string) http.Handler {
 		DeleteMissive(w, r, ds, secret)
 	}).Methods("DELETE")
 
+	for path, target := range map[string]PauseTarget{
+		"/job": PauseJob,
+		"/sub": PauseSubscription,
+		"/missive": PauseMissive,
+	} {
+		target := target
+		r.HandleFunc(path + "/pause", func (w http.ResponseWriter, r *http.Request) {
+			PauseMails(w, r, ds, secret, target, true, waker)
+		}).Methods("POST")
+		r.HandleFunc(path + "/resume", func (w http.ResponseWriter, r *http.Request) {
+			PauseMails(w, r, ds, secret, target, false, waker)
+		}).Methods("POST")
+	}
+
+	r.HandleFunc("/mail/{idem_key}", func (w http.ResponseWriter, r *http.Request) {
+		EditMails(w, r, ds, secret, policy)
+	}).Methods("PATCH")
+
+	r.HandleFunc("/missive/{missive}", func (w http.ResponseWriter, r *http.Request) {
+		EditMails(w, r, ds, secret, policy)
+	}).Methods("PATCH")
+
+	r.HandleFunc("/pause", func (w http.ResponseWriter, r *http.Request) {
+		PauseAll(w, r, ds, secret, true, waker)
+	}).Methods("POST")
+
+	r.HandleFunc("/resume", func (w http.ResponseWriter, r *http.Request) {
+		PauseAll(w, r, ds, secret, false, waker)
+	}).Methods("POST")
+
+	r.HandleFunc("/backup", func (w http.ResponseWriter, r *http.Request) {
+		GetBackup(w, r, ds, secret)
+	}).Methods("GET")
+
+	r.HandleFunc("/audit", func (w http.ResponseWriter, r *http.Request) {
+		GetAudit(w, r, ds, secret)
+	}).Methods("GET")
+
+	r.HandleFunc("/metrics", func (w http.ResponseWriter, r *http.Request) {
+		ServeMetrics(w, r, ds, metricsToken)
+	}).Methods("GET")
+
+	r.HandleFunc("/healthz", ServeHealth).Methods("GET")
+
+	r.HandleFunc("/readyz", func (w http.ResponseWriter, r *http.Request) {
+		ServeReady(w, r, ds, health)
+	}).Methods("GET")
+
+	/* Only if it's been set up */
+	if dash != nil {
+		dash.Routes(r)
+	}
+
 	return r
 }
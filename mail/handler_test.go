@@ -0,0 +1,188 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	tt "testing"
+	"time"
+)
+
+/* A request signed the way checkKey wants */
+func signedRequest(secret string, method string, path string, body string) *http.Request {
+	return signedRequestAs(secret, "", method, path, body)
+}
+
+/* The same, from a named client */
+func signedRequestAs(secret string, client string, method string, path string, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	h := sha256.New()
+	h.Write([]byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte(method))
+	h.Write([]byte(client))
+	r.Header.Set("Authorization", hex.EncodeToString(h.Sum(nil)))
+	r.Header.Set("X-Base58-Timestamp", timestamp)
+	if client != "" {
+		r.Header.Set("X-Base58-Client", client)
+	}
+	return r
+}
+
+func TestAuditEndpoint(t *tt.T) {
+	ds := MemStoreNew()
+	routes := SetupRoutes(ds, "secret", "", nil, NewWaker(), NewWorkerHealth(time.Minute), nil)
+
+	serve := func(r *http.Request) *ReturnVal {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+		var ret ReturnVal
+		if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		return &ret
+	}
+
+	body := `{"job_key": "course", "to_addr": "hi@example.com", "title": "Hi", "text_body": "hi", "send_at": 1}`
+
+	/* The client's name is signed, so it can't be swapped */
+	r := signedRequestAs("secret", "scheduler", "PUT", "/job", body)
+	r.Header.Set("X-Base58-Client", "someone-else")
+	if ret := serve(r); ret.Success {
+		t.Errorf("expecting err for a client it wasn't signed as")
+	}
+	r = signedRequest("secret", "PUT", "/job", body)
+	r.Header.Set("X-Base58-Client", "scheduler")
+	if ret := serve(r); ret.Success {
+		t.Errorf("expecting err for a client it wasn't signed as")
+	}
+
+	r = signedRequestAs("secret", "scheduler", "PUT", "/job", body)
+	r.RemoteAddr = "10.0.0.7:4000"
+	ret := serve(r)
+	if !ret.Success {
+		t.Fatalf("expecting to schedule, got %s", ret.Message)
+	}
+
+	ret = serve(signedRequest("secret", "DELETE", "/job", `{"job_key": "course"}`))
+	if ret.Count != 1 {
+		t.Errorf("expecting %d deleted, got %d", 1, ret.Count)
+	}
+
+	/* Not a mutation, so not audited */
+	serve(signedRequest("secret", "GET", "/audit", ""))
+
+	ret = serve(signedRequest("secret", "GET", "/audit?limit=1", ""))
+	if len(ret.Audit) != 1 || ret.Audit[0].Action != "cancel" || ret.Audit[0].Key != "course" || ret.Next == 0 {
+		t.Fatalf("expecting the cancel, and more to come, got %v (next %d)", ret.Audit, ret.Next)
+	}
+
+	ret = serve(signedRequest("secret", "GET", "/audit?before=" + strconv.FormatInt(ret.Next, 10), ""))
+	if len(ret.Audit) != 1 || ret.Next != 0 {
+		t.Fatalf("expecting the last entry, got %v (next %d)", ret.Audit, ret.Next)
+	}
+	e := ret.Audit[0]
+	if e.Action != "schedule" || e.Client != "scheduler" || e.RemoteAddr != "10.0.0.7:4000" || e.Target != "idem_key" || e.Count != 1 {
+		t.Errorf("expecting the schedule, got %+v", e)
+	}
+
+	if ret = serve(signedRequest("secret", "GET", "/audit?limit=5000", "")); ret.Success {
+		t.Errorf("expecting err for too big a limit")
+	}
+	if ret = serve(httptest.NewRequest("GET", "/audit", nil)); ret.Success {
+		t.Errorf("expecting err for an unsigned request")
+	}
+}
+
+func TestMultipartJob(t *tt.T) {
+	ds := MemStoreNew()
+	policy := DefaultAttachmentPolicy()
+	routes := SetupRoutes(ds, "secret", "", policy, NewWaker(), nil, nil)
+
+	put := func(parts func(*multipart.Writer)) *ReturnVal {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		parts(mw)
+		mw.Close()
+
+		r := signedRequest("secret", "PUT", "/job", body.String())
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+		var ret ReturnVal
+		if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		return &ret
+	}
+
+	ret := put(func(mw *multipart.Writer) {
+		/* Files can come before the request */
+		f, _ := mw.CreateFormFile("file", "invoice.pdf")
+		f.Write([]byte("%PDF-1.4"))
+		mw.WriteField("request", `{"job_key": "course", "to_addr": "hi@example.com", "title": "Hi", "text_body": "hi", "send_at": 1,
+			"attachments": [{"filename": "notes.txt", "content_type": "text/plain", "content_base64": "aGk="}]}`)
+		f, _ = mw.CreateFormFile("file", "data.csv")
+		f.Write([]byte("a,b\n1,2\n"))
+	})
+	if !ret.Success {
+		t.Fatalf("expecting to schedule, got %s", ret.Message)
+	}
+
+	m, err := ds.GetMail(ret.IdemKey)
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	exp := []string{ "notes.txt text/plain", "invoice.pdf application/pdf", "data.csv text/csv; charset=utf-8" }
+	if len(m.Attachments) != len(exp) {
+		t.Fatalf("expecting %d attachments, got %d", len(exp), len(m.Attachments))
+	}
+	for i, a := range m.Attachments {
+		if got := a.Name + " " + a.Type; got != exp[i] {
+			t.Errorf("expecting %s, got %s", exp[i], got)
+		}
+	}
+
+	if ret = put(func(mw *multipart.Writer) {
+		f, _ := mw.CreateFormFile("file", "invoice.pdf")
+		f.Write([]byte("%PDF-1.4"))
+	}); ret.Success {
+		t.Errorf("expecting err without a request part")
+	}
+	if ret = put(func(mw *multipart.Writer) {
+		mw.WriteField("request", `{"job_key": "course", "to_addr": "hi@example.com", "title": "Hi", "text_body": "hi", "send_at": 1}`)
+		mw.WriteField("note", "hello")
+	}); ret.Success {
+		t.Errorf("expecting err for a field that isn't a file")
+	}
+
+	/* Files count towards the limits, however they're sent */
+	if ret = put(func(mw *multipart.Writer) {
+		mw.WriteField("request", `{"job_key": "course", "to_addr": "many@example.com", "title": "Hi", "text_body": "hi", "send_at": 1}`)
+		for i := 0; i <= maxAttachments; i++ {
+			f, _ := mw.CreateFormFile("file", "data.csv")
+			f.Write([]byte("a,b\n1,2\n"))
+		}
+	}); ret.Success {
+		t.Errorf("expecting err for too many files")
+	}
+
+	policy.MaxMessageBytes = 1 << 20
+	if ret = put(func(mw *multipart.Writer) {
+		mw.WriteField("request", `{"job_key": "course", "to_addr": "big@example.com", "title": "Hi", "text_body": "hi", "send_at": 1}`)
+		for i := 0; i < 3; i++ {
+			f, _ := mw.CreateFormFile("file", "data.bin")
+			f.Write(make([]byte, 400 << 10))
+		}
+	}); ret.Success || !strings.Contains(ret.Message, "all told") {
+		t.Errorf("expecting err for files over the limit all told, got %s", ret.Message)
+	}
+}
@@ -0,0 +1,172 @@
+package mail
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Sends in a row that have to fail before a provider's breaker opens,
+ * and how long it stays open */
+const breakerThreshold = 5
+const breakerCooldown = time.Minute
+
+/* WorkerHealth is how the mail worker lets the API know how it's
+ * doing: it beats every time round its loop (and every mail it sends),
+ * and keeps a circuit breaker per provider. If it's gone longer than
+ * stallAfter without a beat, it's stalled. When it fails, it's down
+ * until it's restarted and beats again. */
+type WorkerHealth struct {
+	mu sync.Mutex
+	stallAfter time.Duration
+	lastBeat time.Time
+	breakers map[string]*Breaker
+
+	down bool
+	restarts int
+	lastErr string
+	lastErrAt time.Time
+}
+
+func NewWorkerHealth(stallAfter time.Duration) *WorkerHealth {
+	return &WorkerHealth{
+		stallAfter: stallAfter,
+		/* Give the worker its first loop's grace */
+		lastBeat: time.Now(),
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+func (h *WorkerHealth) Beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastBeat = time.Now()
+	h.down = false
+}
+
+/* The worker's stopped with err, and will be restarted */
+func (h *WorkerHealth) Failed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.down = true
+	h.restarts++
+	h.lastErr = err.Error()
+	h.lastErrAt = time.Now()
+}
+
+
+func (h *WorkerHealth) SinceBeat(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Sub(h.lastBeat)
+}
+
+func (h *WorkerHealth) Stalled(now time.Time) bool {
+	return h.SinceBeat(now) > h.stallAfter
+}
+
+/* The provider's breaker, made on first use */
+func (h *WorkerHealth) Breaker(provider string) *Breaker {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, ok := h.breakers[provider]
+	if !ok {
+		b = NewBreaker(breakerThreshold, breakerCooldown)
+		h.breakers[provider] = b
+	}
+	return b
+}
+
+/* Every provider's breaker state, by provider */
+func (h *WorkerHealth) Circuits(now time.Time) map[string]string {
+	h.mu.Lock()
+	providers := make([]string, 0, len(h.breakers))
+	for p := range h.breakers {
+		providers = append(providers, p)
+	}
+	h.mu.Unlock()
+	sort.Strings(providers)
+
+	circuits := make(map[string]string, len(providers))
+	for _, p := range providers {
+		circuits[p] = h.Breaker(p).State(now)
+	}
+	return circuits
+}
+
+type Readiness struct {
+	Ready bool `json:"ready"`
+	/* "ok", or what went wrong talking to it */
+	Database string `json:"database"`
+	Migration int `json:"migration"`
+	/* Whether this process runs a worker; if not, the worker_
+	 * fields are left out */
+	Worker bool `json:"worker"`
+	WorkerLastLoopSecs float64 `json:"worker_last_loop_secs,omitempty"`
+	WorkerStalled bool `json:"worker_stalled,omitempty"`
+	WorkerDown bool `json:"worker_down,omitempty"`
+	WorkerRestarts int `json:"worker_restarts,omitempty"`
+	/* The last thing that stopped the worker, if anything has */
+	WorkerLastError string `json:"worker_last_error,omitempty"`
+	WorkerLastErrorAt int64 `json:"worker_last_error_at,omitempty"`
+	DueUnsent int64 `json:"due_unsent"`
+	Circuits map[string]string `json:"circuits,omitempty"`
+}
+
+/* The process is up. That's all */
+func ServeHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{ "status": "ok" })
+}
+
+/* Whether we're fit to be sending mail: the database answers and the
+ * worker is up and isn't stuck. An open circuit is reported, but doesn't fail
+ * readiness; the API can still take mail while a provider is down.
+ * health is nil if there's no worker in this process. */
+func ServeReady(w http.ResponseWriter, r *http.Request, ds Datastore, health *WorkerHealth) {
+	now := time.Now()
+	ready := &Readiness{
+		Ready: true,
+		Database: "ok",
+	}
+
+	if health != nil {
+		ready.Worker = true
+		ready.WorkerLastLoopSecs = health.SinceBeat(now).Seconds()
+		ready.WorkerStalled = health.Stalled(now)
+		ready.Circuits = health.Circuits(now)
+
+		health.mu.Lock()
+		ready.WorkerDown = health.down
+		ready.WorkerRestarts = health.restarts
+		ready.WorkerLastError = health.lastErr
+		if !health.lastErrAt.IsZero() {
+			ready.WorkerLastErrorAt = health.lastErrAt.Unix()
+		}
+		health.mu.Unlock()
+	}
+
+	var err error
+	if ready.Migration, err = ds.SchemaVersion(); err == nil {
+		var stats *QueueStats
+		if stats, err = ds.QueueStats(now); err == nil {
+			ready.DueUnsent = stats.Due
+		}
+	}
+	if err != nil {
+		ready.Database = err.Error()
+		ready.Ready = false
+	}
+	if ready.WorkerStalled || ready.WorkerDown {
+		ready.Ready = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
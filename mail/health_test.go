@@ -0,0 +1,140 @@
+package mail
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	tt "testing"
+	"time"
+)
+
+func TestBreaker(t *tt.T) {
+	now := time.Now()
+	b := NewBreaker(3, time.Minute)
+
+	/* A success in among the failures starts the count again */
+	b.Record(true, now)
+	b.Record(true, now)
+	b.Record(false, now)
+	b.Record(true, now)
+	b.Record(true, now)
+	if state := b.State(now); state != CircuitClosed {
+		t.Errorf("expecting %s, got %s", CircuitClosed, state)
+	}
+
+	b.Record(true, now)
+	if b.Allow(now) {
+		t.Errorf("expecting an open breaker to hold off sends")
+	}
+	if !b.RetryAt().Equal(now.Add(time.Minute)) {
+		t.Errorf("expecting retry at %s, got %s", now.Add(time.Minute), b.RetryAt())
+	}
+
+	/* Once it cools down, one try; failing that, open again */
+	later := now.Add(2 * time.Minute)
+	if state := b.State(later); state != CircuitHalfOpen {
+		t.Errorf("expecting %s, got %s", CircuitHalfOpen, state)
+	}
+	b.Record(true, later)
+	if state := b.State(later); state != CircuitOpen {
+		t.Errorf("expecting %s, got %s", CircuitOpen, state)
+	}
+
+	b.Record(false, later.Add(2 * time.Minute))
+	if state := b.State(later); state != CircuitClosed {
+		t.Errorf("expecting %s, got %s", CircuitClosed, state)
+	}
+}
+
+func TestReadiness(t *tt.T) {
+	ds := getDatastore(t)
+	ds.ScheduleMail(&Mail{
+		JobKey: "late",
+		ToAddr: "hi@example.com",
+		Title: "Overdue",
+		TextBody: "hello!",
+		SendAt: Timestamp(time.Now().Add(-time.Hour)),
+	})
+
+	health := NewWorkerHealth(time.Minute)
+	for i := 0; i < breakerThreshold; i++ {
+		health.Breaker("mailgun").Record(true, time.Now())
+	}
+	routes := SetupRoutes(ds, "secret", "", nil, NewWaker(), health, nil)
+
+	ready := func() (int, *Readiness) {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		var rd Readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &rd); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		return w.Code, &rd
+	}
+
+	/* An open circuit alone doesn't make us unready */
+	code, rd := ready()
+	if code != http.StatusOK || !rd.Ready {
+		t.Errorf("expecting ready, got %d %v", code, rd)
+	}
+	if rd.Database != "ok" || rd.Migration != db_migrations[len(db_migrations) - 1].version {
+		t.Errorf("expecting database ok at the latest migration, got %s at %d", rd.Database, rd.Migration)
+	}
+	if rd.DueUnsent != 1 {
+		t.Errorf("expecting %d due, got %d", 1, rd.DueUnsent)
+	}
+	if rd.Circuits["mailgun"] != CircuitOpen {
+		t.Errorf("expecting mailgun %s, got %s", CircuitOpen, rd.Circuits["mailgun"])
+	}
+
+	/* The worker's gone quiet */
+	health.mu.Lock()
+	health.lastBeat = time.Now().Add(-2 * time.Minute)
+	health.mu.Unlock()
+	code, rd = ready()
+	if code != http.StatusServiceUnavailable || rd.Ready || !rd.WorkerStalled {
+		t.Errorf("expecting a stalled worker to be unready, got %d %v", code, rd)
+	}
+
+	/* The worker's failed and is waiting to be restarted */
+	health.Beat()
+	health.Failed(fmt.Errorf("database is locked"))
+	code, rd = ready()
+	if code != http.StatusServiceUnavailable || !rd.WorkerDown || rd.WorkerRestarts != 1 {
+		t.Errorf("expecting a down worker to be unready, got %d %v", code, rd)
+	}
+	if rd.WorkerLastError != "database is locked" {
+		t.Errorf("expecting the worker's error, got %s", rd.WorkerLastError)
+	}
+
+	/* Back up again, the error is still there to see */
+	health.Beat()
+	code, rd = ready()
+	if code != http.StatusOK || rd.WorkerDown || rd.WorkerLastError == "" {
+		t.Errorf("expecting a restarted worker to be ready, got %d %v", code, rd)
+	}
+
+	/* An API without a worker of its own is ready on the database alone */
+	w := httptest.NewRecorder()
+	SetupRoutes(ds, "secret", "", nil, NewWaker(), nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var apiOnly Readiness
+	json.Unmarshal(w.Body.Bytes(), &apiOnly)
+	if w.Code != http.StatusOK || apiOnly.Worker || apiOnly.Circuits != nil {
+		t.Errorf("expecting an API-only process to be ready without a worker, got %d %v", w.Code, apiOnly)
+	}
+
+	/* So has the database */
+	health.Beat()
+	ds.Data.Close()
+	code, rd = ready()
+	if code != http.StatusServiceUnavailable || rd.Database == "ok" {
+		t.Errorf("expecting a closed database to be unready, got %d %v", code, rd)
+	}
+
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expecting %d, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package mail
+
+import (
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+/* We log with log/slog; main sets up the default logger with NewLogger.
+ * Mail contents and secrets have no business in a log line, and
+ * addresses only go in redacted. The handler redacts by key as well,
+ * in case one slips through. */
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"token": true,
+	"secret": true,
+	"html_body": true,
+	"text_body": true,
+	"content": true,
+}
+
+var addrKeys = map[string]bool{
+	"to": true,
+	"to_addr": true,
+	"from_addr": true,
+	"reply_to": true,
+}
+
+/* debug, info, warn or error; blank is info */
+func ParseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+func NewLogger(w io.Writer, level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{ Level: level, ReplaceAttr: redact }
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case redactedKeys[key]:
+		return slog.String(a.Key, "[redacted]")
+	case addrKeys[key]:
+		return slog.String(a.Key, RedactAddr(a.Value.String()))
+	}
+	return a
+}
+
+/* Enough of an address to tell mails apart in the logs: its domain,
+ * and the start of the same hash retention leaves in place of it */
+func RedactAddr(addr string) string {
+	hash := RecipientHash(addr)[:12]
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return hash + "@" + addr[at+1:]
+	}
+	return hash
+}
+
+/* Providers' errors are apt to quote the mail back at us, addresses
+ * and all, so they go in the log with the addresses redacted and cut
+ * down to size. The whole of it is kept, sealed, as the mail's
+ * last_error */
+var addrRe = regexp.MustCompile(`[^\s<>"'(),;:@]+@[A-Za-z0-9.-]+`)
+
+const maxLoggedError = 200
+
+func RedactError(err error) string {
+	msg := addrRe.ReplaceAllStringFunc(err.Error(), RedactAddr)
+	if len(msg) > maxLoggedError {
+		msg = strings.ToValidUTF8(msg[:maxLoggedError], "") + "..."
+	}
+	return msg
+}
+
+/* The fields every log line about a mail carries */
+func MailAttrs(m *Mail) []any {
+	return []any{ "idem_key", m.IdemKey(), "job_key", m.JobKey, "domain", m.Domain }
+}
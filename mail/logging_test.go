@@ -0,0 +1,88 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	tt "testing"
+	"unicode/utf8"
+)
+
+func TestLogRedaction(t *tt.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, slog.LevelInfo, true)
+
+	m := &Mail{
+		JobKey: "course-42",
+		ToAddr: "someone@example.com",
+		Domain: "base58.school",
+		Title: "hello",
+	}
+	log.Info("Sending", append(MailAttrs(m),
+		"to_addr", m.ToAddr,
+		"html_body", "<p>secret stuff</p>",
+		"authorization", "abc123",
+		"attempt", 2)...)
+	log.Debug("Not shown")
+
+	out := buf.String()
+	for _, leak := range []string{"someone", "secret stuff", "abc123", "Not shown"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("expecting %q to be kept out of the log, got %s", leak, out)
+		}
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	if line["idem_key"] != m.IdemKey() || line["job_key"] != "course-42" || line["domain"] != "base58.school" {
+		t.Errorf("expecting the mail's fields, got %v", line)
+	}
+	if line["to_addr"] != RedactAddr(m.ToAddr) {
+		t.Errorf("expecting %s, got %v", RedactAddr(m.ToAddr), line["to_addr"])
+	}
+	if line["attempt"] != float64(2) {
+		t.Errorf("expecting attempt 2, got %v", line["attempt"])
+	}
+}
+
+func TestRedactAddr(t *tt.T) {
+	addr := RedactAddr("someone@example.com")
+	if !strings.HasSuffix(addr, "@example.com") || strings.Contains(addr, "someone") {
+		t.Errorf("expecting a hash at example.com, got %s", addr)
+	}
+	if addr != RedactAddr("someone@example.com") {
+		t.Errorf("expecting the same address to redact the same")
+	}
+	if addr == RedactAddr("someone.else@example.com") {
+		t.Errorf("expecting different addresses to redact differently")
+	}
+	if strings.Contains(RedactAddr("nobody"), "@") {
+		t.Errorf("expecting no domain for an address without one")
+	}
+
+	for _, level := range []string{"", "debug", "INFO", "warn", "error"} {
+		if _, err := ParseLogLevel(level); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Errorf("expecting err for an unknown level")
+	}
+}
+
+func TestRedactError(t *tt.T) {
+	err := fmt.Errorf(`mailgun: 400 {"message": "'to' parameter is not a valid address: <someone@example.com>"}`)
+	msg := RedactError(err)
+	if strings.Contains(msg, "someone") || !strings.Contains(msg, RedactAddr("someone@example.com")) {
+		t.Errorf("expecting the address redacted, got %s", msg)
+	}
+
+	long := RedactError(fmt.Errorf("%s", strings.Repeat("é", maxLoggedError)))
+	if len(long) > maxLoggedError + len("...") || !utf8.ValidString(long) {
+		t.Errorf("expecting the error cut down to size, got %d bytes", len(long))
+	}
+}
@@ -1,9 +1,14 @@
 package mail
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
@@ -39,6 +44,36 @@ func (mr *Mailer) SendMail(m *Mail) (string, error) {
 	return useMailGun(mr, m)
 }
 
+/* Who SendMail hands mail to */
+func (mr *Mailer) Provider() string {
+	return "mailgun"
+}
+
+/* Roughly what went wrong with a send, for metrics: timeout,
+ * rate_limited, rejected (the provider didn't like the mail or
+ * us), provider_error (their problem) or other */
+func ErrorClass(err error) string {
+	var netErr net.Error
+	var respErr *mailgun.UnexpectedResponseError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &respErr):
+		switch {
+		case respErr.Actual == http.StatusTooManyRequests:
+			return "rate_limited"
+		case respErr.Actual >= 500:
+			return "provider_error"
+		case respErr.Actual >= 400:
+			return "rejected"
+		}
+	}
+	return "other"
+}
+
 func useMailGun(mr *Mailer, m *Mail) (string, error) {
 	mg := mailgun.NewMailgun(mr.MailGunDomain, mr.MailGunKey)
 
@@ -62,6 +97,11 @@ func useMailGun(mr *Mailer, m *Mail) (string, error) {
 	msg.SetHtml(m.HTMLBody)
 
 	for _, a := range m.Attachments {
+		if a.Disposition == "inline" {
+			/* Mailgun gives inline files their filename as content id */
+			msg.AddReaderInline(a.ContentID, io.NopCloser(bytes.NewReader(a.Content)))
+			continue
+		}
 		msg.AddBufferAttachment(a.Name, a.Content)
 	}
 
@@ -106,17 +146,21 @@ func useSendGrid(mr *Mailer, m *Mail) error {
 	for _, a := range m.Attachments {
 		attach := mail.NewAttachment()
 		content := base64.StdEncoding.EncodeToString(a.Content)
-		fmt.Printf("sending attachment %s with content %s\n", a.Name, content)
 		attach.SetContent(content)
 		attach.SetFilename(a.Name)
 		attach.SetType(a.Type)
-		attach.SetDisposition("attachment")
+		if a.Disposition == "inline" {
+			attach.SetDisposition("inline")
+			attach.SetContentID(a.ContentID)
+		} else {
+			attach.SetDisposition("attachment")
+		}
 		message.AddAttachment(attach)
 	}
 	client := sendgrid.NewSendClient(mr.SendGridKey)
 	response, err := client.Send(message)
 	if err == nil {
-		fmt.Println("Got status code: ", response.StatusCode)
+		slog.Debug("SendGrid responded", "status", response.StatusCode)
 		/* If not a 200 era code, send a message */
 		if response.StatusCode >= http.StatusMultipleChoices {
 			return fmt.Errorf("%s", response.Body)
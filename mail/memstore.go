@@ -0,0 +1,876 @@
+package mail
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* A mail as the MemStore keeps it: the Mail, plus the
+ * bookkeeping that SQLiteStore keeps in extra columns */
+type memMail struct {
+	Mail
+	attachments []string
+	seq int
+	claimedBy string
+	leaseExpiresAt int64
+	leased bool
+	finishedAt int64
+	recipientHash string
+	stripped bool
+}
+
+/* MemStore is a Datastore that keeps everything in memory. It's
+ * meant for unit tests and for running the mailer in dev mode;
+ * nothing survives a restart. */
+type MemStore struct {
+	mu sync.Mutex
+	mails map[string]*memMail
+	blobs map[string]*memBlob
+	seq int
+	paused bool
+	audit []AuditEntry
+}
+
+type memBlob struct {
+	attachment *Attachment
+	uploadedAt int64
+}
+
+func MemStoreNew() *MemStore {
+	return &MemStore{
+		mails: make(map[string]*memMail),
+		blobs: make(map[string]*memBlob),
+	}
+}
+
+/* Hand out copies, so callers can't reach in and change our state */
+func (ms *MemStore) copy(mm *memMail) *Mail {
+	m := mm.Mail
+	m.Attachments = make(AttachSet, 0, len(mm.attachments))
+	for _, hash := range mm.attachments {
+		a := *ms.blobs[hash].attachment
+		m.Attachments = append(m.Attachments, &a)
+	}
+	m.AttachmentRefs = nil
+	return &m
+}
+
+/* Matching rows, in insertion order */
+func (ms *MemStore) where(match func(mm *memMail) bool) []*memMail {
+	var rows []*memMail
+	for _, mm := range ms.mails {
+		if match(mm) {
+			rows = append(rows, mm)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].seq < rows[j].seq
+	})
+	return rows
+}
+
+func (ms *MemStore) copyAll(rows []*memMail) []*Mail {
+	mails := make([]*Mail, len(rows))
+	for i, mm := range rows {
+		mails[i] = ms.copy(mm)
+	}
+	return mails
+}
+
+func (mm *memMail) sendAt() int64 {
+	return time.Time(mm.SendAt).UTC().Unix()
+}
+
+func (mm *memMail) leaseLapsed(now int64) bool {
+	return !mm.leased || mm.leaseExpiresAt <= now
+}
+
+func (mm *memMail) release(state ScheduleState) {
+	mm.State = state
+	mm.claimedBy = ""
+	mm.leased = false
+	mm.leaseExpiresAt = 0
+}
+
+/* What a resumed or released mail goes back to */
+func (mm *memMail) waitingState() ScheduleState {
+	if mm.TryCount > 0 {
+		return FAILED
+	}
+	return UNSENT
+}
+
+func (mm *memMail) editable() bool {
+	return mm.State == UNSENT || mm.State == FAILED || mm.State == PAUSED
+}
+
+/* Order rows the way SQLiteStore's batches are: priority first,
+ * then taking turns between job keys, then by send time, job key
+ * and idem key */
+func fairOrder(rows []*memMail) {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].sendAt() != rows[j].sendAt() {
+			return rows[i].sendAt() < rows[j].sendAt()
+		}
+		if rows[i].JobKey != rows[j].JobKey {
+			return rows[i].JobKey < rows[j].JobKey
+		}
+		return rows[i].IdemKey() < rows[j].IdemKey()
+	})
+
+	type group struct {
+		prio Priority
+		job string
+	}
+	turns := make(map[*memMail]int)
+	counts := make(map[group]int)
+	for _, mm := range rows {
+		g := group{ mm.Priority, mm.JobKey }
+		counts[g]++
+		turns[mm] = counts[g]
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Priority != rows[j].Priority {
+			return rows[i].Priority > rows[j].Priority
+		}
+		return turns[rows[i]] < turns[rows[j]]
+	})
+}
+
+func (ms *MemStore) ScheduleMail(m *Mail) error {
+	return ms.insertMail(m, UNSENT, 0, sql.NullString{})
+}
+
+func (ms *MemStore) ImportMail(m *Mail) error {
+	return ms.insertMail(m, m.State, m.TryCount, m.ProviderID)
+}
+
+func (ms *MemStore) insertMail(m *Mail, state ScheduleState, tryCount int, providerID sql.NullString) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := m.IdemKey()
+	if _, ok := ms.mails[key]; ok {
+		return fmt.Errorf("Mail %s %w", key, ErrAlreadyScheduled)
+	}
+
+	hashes, err := ms.attachAll(m.Attachments, m.AttachmentRefs)
+	if err != nil {
+		return err
+	}
+
+	ms.seq++
+	mm := &memMail{ Mail: *m, seq: ms.seq, attachments: hashes }
+	mm.Idem = key
+	mm.State = state
+	mm.TryCount = tryCount
+	mm.ProviderID = providerID
+	mm.Revision = 0
+	mm.SendAt = Timestamp(time.Unix(mm.sendAt(), 0))
+	mm.Attachments = nil
+	mm.AttachmentRefs = nil
+	ms.mails[key] = mm
+
+	m.Idem = key
+	return nil
+}
+
+func (ms *MemStore) GetMail(idemKey string) (*Mail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mm, ok := ms.mails[idemKey]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return ms.copy(mm), nil
+}
+
+func (ms *MemStore) GetJob(jobKey string) ([]*Mail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.copyAll(ms.where(func(mm *memMail) bool {
+		return mm.JobKey == jobKey
+	})), nil
+}
+
+func (ms *MemStore) ListJobs(state *ScheduleState) ([]*Mail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.copyAll(ms.where(func(mm *memMail) bool {
+		return state != nil && mm.State == *state
+	})), nil
+}
+
+func (ms *MemStore) FindMails(filter *MailFilter, after string, limit int) ([]*Mail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	rows := ms.where(func(mm *memMail) bool {
+		return mm.Idem > after &&
+			(filter.State == "" || mm.State == filter.State) &&
+			(filter.JobKey == "" || mm.JobKey == filter.JobKey) &&
+			(filter.Missive == "" || (mm.Missive.Valid && mm.Missive.String == filter.Missive)) &&
+			(filter.SendFrom.IsZero() || mm.sendAt() >= filter.SendFrom.UTC().Unix()) &&
+			(filter.SendTo.IsZero() || mm.sendAt() < filter.SendTo.UTC().Unix())
+	})
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Idem < rows[j].Idem
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return ms.copyAll(rows), nil
+}
+
+func (ms *MemStore) SetState(idemKey string, state ScheduleState) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mm, ok := ms.mails[idemKey]; ok {
+		mm.State = state
+	}
+	return nil
+}
+
+func (ms *MemStore) GetToSendBatch(when time.Time, batchSize int, workerID string, lease time.Duration) ([]*Mail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := when.UTC().Unix()
+	due := ms.where(func(mm *memMail) bool {
+		waiting := (mm.State == FAILED && mm.TryCount < 20) ||
+			mm.State == UNSENT ||
+			(mm.State == INPROG && mm.TryCount < 20 && mm.leaseLapsed(now))
+		return waiting && mm.sendAt() <= now && !mm.Expired(when)
+	})
+
+	fairOrder(due)
+	if len(due) > batchSize {
+		due = due[:batchSize]
+	}
+
+	for _, mm := range due {
+		/* A lapsed claim counts as a try */
+		if mm.State == INPROG {
+			mm.TryCount++
+		}
+		mm.State = INPROG
+		mm.claimedBy = workerID
+		mm.leased = true
+		mm.leaseExpiresAt = when.Add(lease).UTC().Unix()
+	}
+
+	claimed := ms.where(func(mm *memMail) bool {
+		return mm.State == INPROG && mm.claimedBy == workerID
+	})
+	fairOrder(claimed)
+	return ms.copyAll(claimed), nil
+}
+
+func (ms *MemStore) ExtendLease(workerID string, until time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, mm := range ms.mails {
+		if mm.State == INPROG && mm.claimedBy == workerID {
+			mm.leased = true
+			mm.leaseExpiresAt = until.UTC().Unix()
+		}
+	}
+	return nil
+}
+
+func (ms *MemStore) ReleaseClaims(workerID string, keep ...string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	kept := make(map[string]bool, len(keep))
+	for _, key := range keep {
+		kept[key] = true
+	}
+
+	var count int64
+	for key, mm := range ms.mails {
+		if mm.State == INPROG && mm.claimedBy == workerID && !kept[key] {
+			mm.release(mm.waitingState())
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemStore) ResetInProgress() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now().UTC().Unix()
+	for _, mm := range ms.mails {
+		if mm.State == INPROG && mm.leaseLapsed(now) {
+			mm.release(FAILED)
+		}
+	}
+	return nil
+}
+
+/* There's no schema to migrate, so it's always up to date */
+func (ms *MemStore) SchemaVersion() (int, error) {
+	return db_migrations[len(db_migrations) - 1].version, nil
+}
+
+func (ms *MemStore) QueueStats(when time.Time) (*QueueStats, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := when.UTC().Unix()
+	stats := &QueueStats{}
+	counts := make(map[QueueCount]int64)
+	for _, mm := range ms.mails {
+		counts[QueueCount{ State: mm.State, Domain: mm.Domain }]++
+
+		waiting := (mm.State == FAILED && mm.TryCount < 20) ||
+			mm.State == UNSENT ||
+			(mm.State == INPROG && mm.TryCount < 20 && mm.leaseLapsed(now))
+		if waiting && mm.sendAt() <= now && !mm.Expired(when) {
+			stats.Due++
+			if stats.OldestDue.IsZero() || mm.sendAt() < stats.OldestDue.Unix() {
+				stats.OldestDue = time.Unix(mm.sendAt(), 0)
+			}
+		}
+	}
+
+	for c, count := range counts {
+		c.Count = count
+		stats.Counts = append(stats.Counts, c)
+	}
+	sort.Slice(stats.Counts, func(i, j int) bool {
+		a, b := stats.Counts[i], stats.Counts[j]
+		return a.State < b.State || (a.State == b.State && a.Domain < b.Domain)
+	})
+	return stats, nil
+}
+
+func (ms *MemStore) CountByJob() ([]*MailCount, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	byKey := make(map[MailCount]int64)
+	for _, mm := range ms.mails {
+		byKey[MailCount{ JobKey: mm.JobKey, Missive: mm.Missive, State: mm.State }]++
+	}
+
+	counts := make([]*MailCount, 0, len(byKey))
+	for key, count := range byKey {
+		c := key
+		c.Count = count
+		counts = append(counts, &c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if a.JobKey != b.JobKey {
+			return a.JobKey < b.JobKey
+		}
+		if a.Missive != b.Missive {
+			return !a.Missive.Valid || (b.Missive.Valid && a.Missive.String < b.Missive.String)
+		}
+		return a.State < b.State
+	})
+	return counts, nil
+}
+
+func (ms *MemStore) CountWaiting(until time.Time, limit int) ([]*MailCount, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	byKey := make(map[MailCount]int64)
+	for _, mm := range ms.mails {
+		waiting := mm.State == UNSENT || mm.State == FAILED || mm.State == INPROG
+		if waiting && mm.sendAt() < until.UTC().Unix() {
+			byKey[MailCount{ JobKey: mm.JobKey, SendAt: mm.sendAt() }]++
+		}
+	}
+
+	counts := make([]*MailCount, 0, len(byKey))
+	for key, count := range byKey {
+		c := key
+		c.Count = count
+		counts = append(counts, &c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		return a.SendAt < b.SendAt || (a.SendAt == b.SendAt && a.JobKey < b.JobKey)
+	})
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts, nil
+}
+
+func (ms *MemStore) FailingMails(limit int) ([]*Mail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	rows := ms.where(func(mm *memMail) bool { return mm.State == FAILED })
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		return a.sendAt() < b.sendAt() || (a.sendAt() == b.sendAt() && a.Idem < b.Idem)
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+
+	mails := make([]*Mail, len(rows))
+	for i, mm := range rows {
+		m := mm.Mail
+		m.HTMLBody, m.TextBody = "", ""
+		m.Attachments, m.AttachmentRefs = nil, nil
+		mails[i] = &m
+	}
+	return mails, nil
+}
+
+func (ms *MemStore) NextSendAt() (next time.Time, ok bool, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var at int64
+	consider := func(t int64) {
+		if !ok || t < at {
+			at = t
+			ok = true
+		}
+	}
+
+	for _, mm := range ms.mails {
+		switch {
+		case mm.State == UNSENT, mm.State == FAILED && mm.TryCount < 20:
+			consider(mm.sendAt())
+		case mm.State == INPROG && mm.TryCount < 20 && mm.leased:
+			consider(mm.leaseExpiresAt)
+		}
+	}
+
+	if !ok {
+		return next, false, nil
+	}
+	return time.Unix(at, 0), true, nil
+}
+
+func (ms *MemStore) ExpireStale(when time.Time) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := when.UTC().Unix()
+	var count int64
+	for _, mm := range ms.mails {
+		waiting := mm.State == UNSENT || mm.State == FAILED ||
+			(mm.State == INPROG && mm.leaseLapsed(now))
+		if waiting && mm.Expired(when) {
+			mm.finish(EXPIRED)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (mm *memMail) finish(state ScheduleState) {
+	mm.release(state)
+	mm.finishedAt = time.Now().UTC().Unix()
+}
+
+func (ms *MemStore) MarkSent(idemKey string, providerID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mm, ok := ms.mails[idemKey]; ok {
+		mm.finish(SENT)
+		mm.ProviderID = sql.NullString{ String: providerID, Valid: true }
+	}
+	return nil
+}
+
+func (ms *MemStore) MarkExpired(idemKey string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mm, ok := ms.mails[idemKey]; ok {
+		mm.finish(EXPIRED)
+	}
+	return nil
+}
+
+func (ms *MemStore) RescheduleFailed(idemKey string, tryCount int, sendAt int64, lastErr string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mm, ok := ms.mails[idemKey]; ok {
+		mm.release(FAILED)
+		mm.TryCount = tryCount
+		mm.SendAt = Timestamp(time.Unix(sendAt, 0))
+		mm.LastError = sql.NullString{ String: lastErr, Valid: true }
+	}
+	return nil
+}
+
+func (ms *MemStore) RetryMail(idemKey string, when time.Time) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mm, ok := ms.mails[idemKey]
+	if !ok || (mm.State != FAILED && mm.State != EXPIRED) || mm.stripped {
+		return 0, nil
+	}
+	mm.release(UNSENT)
+	mm.TryCount = 0
+	mm.SendAt = Timestamp(when)
+	mm.ExpiresAt = sql.NullInt64{}
+	mm.finishedAt = 0
+	return 1, nil
+}
+
+func (ms *MemStore) deleteWhere(match func(mm *memMail) bool) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var count int64
+	for key, mm := range ms.mails {
+		if match(mm) {
+			delete(ms.mails, key)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemStore) DeleteJob(jobKey string) (int64, error) {
+	return ms.deleteWhere(func(mm *memMail) bool {
+		return mm.JobKey == jobKey && mm.editable()
+	})
+}
+
+func (ms *MemStore) DeleteSubscription(subKey string) (int64, error) {
+	return ms.deleteWhere(func(mm *memMail) bool {
+		return mm.Sub.Valid && mm.Sub.String == subKey && mm.editable()
+	})
+}
+
+func (ms *MemStore) CancelMissive(missive string) (int64, error) {
+	return ms.deleteWhere(func(mm *memMail) bool {
+		return mm.Missive.Valid && mm.Missive.String == missive && mm.State != SENT
+	})
+}
+
+func (ms *MemStore) CancelMail(idemKey string) (int64, error) {
+	return ms.deleteWhere(func(mm *memMail) bool {
+		return mm.Idem == idemKey && mm.State != SENT
+	})
+}
+
+func (ms *MemStore) CancelJob(jobKey string) (int64, error) {
+	return ms.deleteWhere(func(mm *memMail) bool {
+		return mm.JobKey == jobKey && mm.State != SENT
+	})
+}
+
+func (mm *memMail) matches(target PauseTarget, key string) bool {
+	switch target {
+	case PauseJob:
+		return mm.JobKey == key
+	case PauseSubscription:
+		return mm.Sub.Valid && mm.Sub.String == key
+	case PauseMissive:
+		return mm.Missive.Valid && mm.Missive.String == key
+	case PauseMail:
+		return mm.Idem == key
+	}
+	return false
+}
+
+func (ms *MemStore) Pause(target PauseTarget, key string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var count int64
+	for _, mm := range ms.mails {
+		if mm.matches(target, key) && (mm.State == UNSENT || mm.State == FAILED) {
+			mm.State = PAUSED
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemStore) Resume(target PauseTarget, key string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var count int64
+	for _, mm := range ms.mails {
+		if mm.matches(target, key) && mm.State == PAUSED {
+			mm.State = mm.waitingState()
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemStore) SetPaused(paused bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.paused = paused
+	return nil
+}
+
+func (ms *MemStore) IsPaused() (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.paused, nil
+}
+
+func (ms *MemStore) EditMail(idemKey string, edit *MailEdit) (int64, error) {
+	return ms.editWhere(func(mm *memMail) bool {
+		return mm.Idem == idemKey
+	}, edit)
+}
+
+func (ms *MemStore) EditMissive(missive string, edit *MailEdit) (int64, error) {
+	return ms.editWhere(func(mm *memMail) bool {
+		return mm.Missive.Valid && mm.Missive.String == missive
+	}, edit)
+}
+
+func (ms *MemStore) editWhere(match func(mm *memMail) bool, edit *MailEdit) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if *edit == (MailEdit{}) {
+		return 0, fmt.Errorf("Nothing to edit")
+	}
+
+	rows := ms.where(func(mm *memMail) bool {
+		return match(mm) && mm.editable()
+	})
+
+	/* Check nothing's left without a body before changing anything */
+	var blank int
+	for _, mm := range rows {
+		html, text := mm.HTMLBody, mm.TextBody
+		if edit.HTMLBody != nil {
+			html = *edit.HTMLBody
+		}
+		if edit.TextBody != nil {
+			text = *edit.TextBody
+		}
+		if html == "" && text == "" {
+			blank++
+		}
+	}
+	if blank > 0 {
+		return 0, fmt.Errorf("Edit would leave %d mails with neither html_body nor text_body", blank)
+	}
+
+	var hashes []string
+	if edit.Attachments != nil || edit.AttachmentRefs != nil {
+		var inline AttachSet
+		var refs []string
+		if edit.Attachments != nil {
+			inline = *edit.Attachments
+		}
+		if edit.AttachmentRefs != nil {
+			refs = *edit.AttachmentRefs
+		}
+
+		var err error
+		if hashes, err = ms.attachAll(inline, refs); err != nil {
+			return 0, err
+		}
+	}
+
+	nullable := func(s string) sql.NullString {
+		return sql.NullString{ String: s, Valid: s != "" }
+	}
+
+	for _, mm := range rows {
+		if edit.Title != nil {
+			mm.Title = *edit.Title
+		}
+		if edit.HTMLBody != nil {
+			mm.HTMLBody = *edit.HTMLBody
+		}
+		if edit.TextBody != nil {
+			mm.TextBody = *edit.TextBody
+		}
+		if hashes != nil {
+			mm.attachments = hashes
+		}
+		if edit.FromAddr != nil {
+			mm.FromAddr = nullable(*edit.FromAddr)
+		}
+		if edit.FromName != nil {
+			mm.FromName = nullable(*edit.FromName)
+		}
+		if edit.ReplyTo != nil {
+			mm.ReplyTo = nullable(*edit.ReplyTo)
+		}
+		mm.Revision++
+	}
+
+	return int64(len(rows)), nil
+}
+
+func (ms *MemStore) putAttachment(a *Attachment, now int64) string {
+	hash := a.Hash()
+	if blob, ok := ms.blobs[hash]; ok {
+		blob.uploadedAt = now
+		return hash
+	}
+
+	stored := *a
+	ms.blobs[hash] = &memBlob{ attachment: &stored, uploadedAt: now }
+	return hash
+}
+
+/* Checks the refs before storing anything, so a bad ref leaves no trace */
+func (ms *MemStore) attachAll(inline AttachSet, refs []string) ([]string, error) {
+	for _, ref := range refs {
+		if _, ok := ms.blobs[ref]; !ok {
+			return nil, fmt.Errorf("Unknown attachment %s, upload it first", ref)
+		}
+	}
+
+	now := time.Now().UTC().Unix()
+	hashes := make([]string, 0, len(inline) + len(refs))
+	for _, a := range inline {
+		hashes = append(hashes, ms.putAttachment(a, now))
+	}
+	return append(hashes, refs...), nil
+}
+
+func (ms *MemStore) PutAttachment(a *Attachment) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.putAttachment(a, time.Now().UTC().Unix()), nil
+}
+
+func (ms *MemStore) GetAttachments(hashes []string) (AttachSet, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	as := make(AttachSet, 0, len(hashes))
+	for _, hash := range hashes {
+		blob, ok := ms.blobs[hash]
+		if !ok {
+			return nil, fmt.Errorf("Unknown attachment %s, upload it first", hash)
+		}
+		a := *blob.attachment
+		as = append(as, &a)
+	}
+	return as, nil
+}
+
+func (ms *MemStore) CollectAttachments(grace time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	live := make(map[string]bool)
+	for _, mm := range ms.mails {
+		for _, hash := range mm.attachments {
+			live[hash] = true
+		}
+	}
+
+	var count int64
+	cutoff := time.Now().Add(-grace).UTC().Unix()
+	for hash, blob := range ms.blobs {
+		if !live[hash] && blob.uploadedAt <= cutoff {
+			delete(ms.blobs, hash)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemStore) PurgeFinished(stripBefore time.Time, deleteBefore time.Time) (stripped int64, deleted int64, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for key, mm := range ms.mails {
+		if mm.State != SENT && mm.State != EXPIRED {
+			continue
+		}
+
+		/* Same as SQLiteStore, go by send time if we didn't see it finish */
+		finishedAt := mm.finishedAt
+		if finishedAt == 0 {
+			finishedAt = mm.sendAt()
+		}
+
+		if !deleteBefore.IsZero() && finishedAt <= deleteBefore.UTC().Unix() {
+			delete(ms.mails, key)
+			deleted++
+			continue
+		}
+
+		if !stripBefore.IsZero() && !mm.stripped && finishedAt <= stripBefore.UTC().Unix() {
+			mm.recipientHash = RecipientHash(mm.ToAddr)
+			mm.ToAddr = ""
+			mm.ToName = sql.NullString{}
+			mm.HTMLBody = ""
+			mm.TextBody = ""
+			mm.LastError = sql.NullString{}
+			mm.attachments = nil
+			mm.stripped = true
+			stripped++
+		}
+	}
+	return stripped, deleted, nil
+}
+
+func (ms *MemStore) RecordAudit(entry *AuditEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry.ID = int64(len(ms.audit) + 1)
+	ms.audit = append(ms.audit, *entry)
+	return nil
+}
+
+func (ms *MemStore) FindAudit(filter *AuditFilter, before int64, limit int) ([]*AuditEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var entries []*AuditEntry
+	for i := len(ms.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := ms.audit[i]
+		switch {
+		case before > 0 && e.ID >= before:
+		case filter.Client != "" && e.Client != filter.Client:
+		case filter.Action != "" && e.Action != filter.Action:
+		case filter.Key != "" && e.Key != filter.Key:
+		case !filter.Since.IsZero() && e.At < filter.Since.UTC().Unix():
+		case !filter.Until.IsZero() && e.At >= filter.Until.UTC().Unix():
+		default:
+			entries = append(entries, &e)
+		}
+	}
+	return entries, nil
+}
+
+/* Nothing to give back */
+func (ms *MemStore) Vacuum() error {
+	return nil
+}
+
+/* Nothing's kept at rest, so there's nothing to re-encrypt */
+func (ms *MemStore) Reencrypt(batchSize int) (int64, error) {
+	return 0, nil
+}
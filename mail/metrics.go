@@ -0,0 +1,251 @@
+package mail
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* What we export on /metrics, in the Prometheus text format. All we
+ * need are counters and histograms, labelled; gauges are read off the
+ * datastore at scrape time. */
+type metricVec struct {
+	mu sync.Mutex
+	name string
+	help string
+	kind string
+	labels []string
+	/* Upper bounds, for histograms */
+	buckets []float64
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value float64
+	/* Histograms: observations at or under each bucket's bound */
+	counts []uint64
+	count uint64
+}
+
+func newCounter(name string, help string, labels ...string) *metricVec {
+	return &metricVec{ name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*series) }
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{ name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: make(map[string]*series) }
+}
+
+/* Callers hold v.mu */
+func (v *metricVec) get(labels []string) *series {
+	if len(labels) != len(v.labels) {
+		panic(fmt.Sprintf("%s wants %d labels, got %d", v.name, len(v.labels), len(labels)))
+	}
+
+	key := strings.Join(labels, "\x00")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{ labels: labels, counts: make([]uint64, len(v.buckets)) }
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) Add(delta float64, labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labels).value += delta
+}
+
+func (v *metricVec) Inc(labels ...string) {
+	v.Add(1, labels...)
+}
+
+func (v *metricVec) Observe(val float64, labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.get(labels)
+	for i, bound := range v.buckets {
+		if val <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += val
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labelSet(v.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+
+		names := append(append([]string{}, v.labels...), "le")
+		for i, bound := range v.buckets {
+			values := append(append([]string{}, s.labels...), formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelSet(names, values), s.counts[i])
+		}
+		values := append(append([]string{}, s.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelSet(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labelSet(v.labels, s.labels), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labelSet(v.labels, s.labels), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name string, labels []string, values []string, val float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labelSet(labels, values), formatFloat(val))
+}
+
+func labelSet(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escape.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+var (
+	sendBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	httpBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+	mailsSent = newCounter("mailer_mails_sent_total",
+		"Mails handed off to a provider", "provider", "domain")
+	sendFailures = newCounter("mailer_send_failures_total",
+		"Attempts to send that failed, by what went wrong", "provider", "domain", "error_class")
+	sendDuration = newHistogram("mailer_send_duration_seconds",
+		"How long handing a mail to the provider took", sendBuckets, "provider", "domain")
+	sendRetries = newCounter("mailer_send_retries_total",
+		"Failed mails rescheduled for another try", "domain")
+	mailsExpired = newCounter("mailer_mails_expired_total",
+		"Mails given up on for passing their deadline")
+	httpRequests = newCounter("mailer_http_requests_total",
+		"API requests, by route and response status", "route", "method", "status")
+	httpDuration = newHistogram("mailer_http_request_duration_seconds",
+		"How long API requests took", httpBuckets, "route", "method")
+	authFailures = newCounter("mailer_auth_failures_total",
+		"API requests turned away for a bad auth token or timestamp", "route")
+
+	allMetrics = []*metricVec{ mailsSent, sendFailures, sendDuration, sendRetries, mailsExpired, httpRequests, httpDuration, authFailures }
+)
+
+/* Record a try at sending m through provider */
+func RecordSend(provider string, domain string, took time.Duration, err error) {
+	sendDuration.Observe(took.Seconds(), provider, domain)
+	if err != nil {
+		sendFailures.Inc(provider, domain, ErrorClass(err))
+		return
+	}
+	mailsSent.Inc(provider, domain)
+}
+
+func RecordRetry(domain string) {
+	sendRetries.Inc(domain)
+}
+
+func RecordExpired(count int64) {
+	mailsExpired.Add(float64(count))
+}
+
+/* The route a request matched, rather than its path, so that keys in
+ * the path don't each get their own series */
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+/* Count and time every request that matches a route */
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ ResponseWriter: w, status: http.StatusOK }
+		next.ServeHTTP(sr, r)
+
+		route := routeName(r)
+		httpRequests.Inc(route, r.Method, strconv.Itoa(sr.status))
+		httpDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+/* Prometheus scrapes can't sign requests, so /metrics takes a bearer
+ * token instead, if one's been set */
+func ServeMetrics(w http.ResponseWriter, r *http.Request, ds Datastore, token string) {
+	if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer " + token)) != 1 {
+		authFailures.Inc(routeName(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	stats, err := ds.QueueStats(time.Now())
+	if err != nil {
+		slog.Error("Unable to get queue stats", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP mailer_queue_mails Mails in the datastore, by state and domain\n# TYPE mailer_queue_mails gauge\n")
+	for _, c := range stats.Counts {
+		writeGauge(w, "mailer_queue_mails", []string{"state", "domain"}, []string{string(c.State), c.Domain}, float64(c.Count))
+	}
+
+	fmt.Fprintf(w, "# HELP mailer_due_unsent_mails Mails due to go out by now that haven't\n# TYPE mailer_due_unsent_mails gauge\n")
+	writeGauge(w, "mailer_due_unsent_mails", nil, nil, float64(stats.Due))
+
+	oldest := 0.0
+	if !stats.OldestDue.IsZero() {
+		oldest = time.Since(stats.OldestDue).Seconds()
+	}
+	fmt.Fprintf(w, "# HELP mailer_oldest_due_unsent_seconds How long the longest-waiting due mail has been due\n# TYPE mailer_oldest_due_unsent_seconds gauge\n")
+	writeGauge(w, "mailer_oldest_due_unsent_seconds", nil, nil, oldest)
+
+	for _, v := range allMetrics {
+		v.write(w)
+	}
+}
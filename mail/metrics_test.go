@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	tt "testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v4"
+)
+
+func TestMetricFormat(t *tt.T) {
+	sends := newCounter("test_sends_total", "Sends", "domain")
+	sends.Inc("a.example")
+	sends.Add(2, `quote"d`)
+
+	took := newHistogram("test_seconds", "Time taken", []float64{0.5, 1}, "domain")
+	took.Observe(0.25, "a.example")
+	took.Observe(0.75, "a.example")
+	took.Observe(5, "a.example")
+
+	var out strings.Builder
+	sends.write(&out)
+	took.write(&out)
+
+	expected := `# HELP test_sends_total Sends
+# TYPE test_sends_total counter
+test_sends_total{domain="a.example"} 1
+test_sends_total{domain="quote\"d"} 2
+# HELP test_seconds Time taken
+# TYPE test_seconds histogram
+test_seconds_bucket{domain="a.example",le="0.5"} 1
+test_seconds_bucket{domain="a.example",le="1"} 2
+test_seconds_bucket{domain="a.example",le="+Inf"} 3
+test_seconds_sum{domain="a.example"} 6
+test_seconds_count{domain="a.example"} 3
+`
+	if out.String() != expected {
+		t.Errorf("expecting\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestErrorClass(t *tt.T) {
+	for err, class := range map[error]string{
+		context.DeadlineExceeded: "timeout",
+		fmt.Errorf("sending: %w", context.DeadlineExceeded): "timeout",
+		&mailgun.UnexpectedResponseError{ Actual: 429 }: "rate_limited",
+		&mailgun.UnexpectedResponseError{ Actual: 400 }: "rejected",
+		&mailgun.UnexpectedResponseError{ Actual: 502 }: "provider_error",
+		fmt.Errorf("no route to host"): "other",
+	} {
+		if got := ErrorClass(err); got != class {
+			t.Errorf("expecting %s for %s, got %s", class, err, got)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *tt.T) {
+	ds := MemStoreNew()
+	ds.ScheduleMail(&Mail{
+		JobKey: "late",
+		ToAddr: "hi@example.com",
+		Title: "Overdue",
+		TextBody: "hello!",
+		SendAt: Timestamp(time.Now().Add(-time.Hour)),
+		Domain: "base58.school",
+	})
+
+	routes := SetupRoutes(ds, "secret", "token", nil, NewWaker(), NewWorkerHealth(time.Minute), nil)
+
+	/* Turned away without the token */
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expecting %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	/* An unsigned PATCH counts as an auth failure for its route */
+	routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/mail/abc", nil))
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	routes.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expecting %d, got %d", http.StatusOK, w.Code)
+	}
+
+	for _, line := range []string{
+		`mailer_queue_mails{state="unsent",domain="base58.school"} 1`,
+		`mailer_due_unsent_mails 1`,
+		`mailer_auth_failures_total{route="/mail/{idem_key}"}`,
+		`mailer_http_requests_total{route="/metrics",method="GET",status="401"}`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("expecting %s in\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,605 @@
+package mail
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/* Where we keep track of the schema. schema_migrations has a row per
+ * migration applied, with a checksum of what was run so we can tell if
+ * it's been edited since. */
+var db_setup_exec = []string{
+	`CREATE TABLE IF NOT EXISTS db_metadata (key TEXT NOT NULL PRIMARY KEY, value TEXT);`,
+	`CREATE TABLE IF NOT EXISTS schema_migrations
+		(
+			version INT NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		);`,
+}
+
+/* Most migrations are a single SQL statement; the odd one that can't
+ * be done in SQL alone is a func run inside the migration transaction.
+ * Either way, down (or undo) reverses it; a migration with neither
+ * can't be rolled back.
+ *
+ * Versions must only ever go up. Don't edit a migration once it's
+ * been released, add another. */
+type dbMigration struct {
+	version int
+	name string
+	stmt string
+	apply func(tx *sqlx.Tx) error
+	down string
+	undo func(tx *sqlx.Tx) error
+}
+
+var db_migrations = []dbMigration{
+	{version: 1, name: "create_scheduled",
+		stmt: `CREATE TABLE scheduled 
+		(	
+			idem_key TEXT NOT NULL PRIMARY KEY,
+			job_key TEXT NOT NULL,
+			to_addr TEXT NOT NULL,
+			to_name TEXT,
+			from_addr TEXT,
+			from_name TEXT,
+			reply_to TEXT,
+			title TEXT NOT NULL,
+			html_body TEXT NOT NULL,
+			text_body TEXT NOT NULL,
+			attachments BLOB,
+			send_at BIGINT NOT NULL,
+			state TEXT NOT NULL DEFAULT 'unsent',
+			try_count INT NOT NULL DEFAULT 0
+	        );`,
+		down: `DROP TABLE scheduled;`},
+	{version: 2, name: "scheduled_mail_domain",
+		stmt: `ALTER TABLE scheduled ADD COLUMN mail_domain TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN mail_domain;`},
+	{version: 3, name: "scheduled_sub",
+		stmt: `ALTER TABLE scheduled ADD COLUMN sub TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN sub;`},
+	{version: 4, name: "scheduled_missive",
+		stmt: `ALTER TABLE scheduled ADD COLUMN missive TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN missive;`},
+	{version: 5, name: "scheduled_claimed_by",
+		stmt: `ALTER TABLE scheduled ADD COLUMN claimed_by TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN claimed_by;`},
+	{version: 6, name: "scheduled_lease_expires_at",
+		stmt: `ALTER TABLE scheduled ADD COLUMN lease_expires_at BIGINT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN lease_expires_at;`},
+	{version: 7, name: "scheduled_priority",
+		stmt: `ALTER TABLE scheduled ADD COLUMN priority INT NOT NULL DEFAULT 0;`,
+		down: `ALTER TABLE scheduled DROP COLUMN priority;`},
+	{version: 8, name: "scheduled_expires_at",
+		stmt: `ALTER TABLE scheduled ADD COLUMN expires_at BIGINT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN expires_at;`},
+	{version: 9, name: "scheduled_revision",
+		stmt: `ALTER TABLE scheduled ADD COLUMN revision INT NOT NULL DEFAULT 0;`,
+		down: `ALTER TABLE scheduled DROP COLUMN revision;`},
+	{version: 10, name: "scheduled_edited_at",
+		stmt: `ALTER TABLE scheduled ADD COLUMN edited_at BIGINT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN edited_at;`},
+	{version: 11, name: "rekey_idem_keys",
+		apply: rekeyIdemKeys},
+	{version: 12, name: "create_attachments",
+		stmt: `CREATE TABLE attachments
+		(
+			hash TEXT NOT NULL PRIMARY KEY,
+			data BLOB NOT NULL,
+			size INT NOT NULL,
+			uploaded_at BIGINT NOT NULL
+		);`,
+		down: `DROP TABLE attachments;`},
+	{version: 13, name: "create_mail_attachments",
+		stmt: `CREATE TABLE mail_attachments
+		(
+			idem_key TEXT NOT NULL,
+			seq INT NOT NULL,
+			hash TEXT NOT NULL,
+			PRIMARY KEY (idem_key, seq)
+		);`,
+		down: `DROP TABLE mail_attachments;`},
+	{version: 14, name: "mail_attachments_hash_index",
+		stmt: `CREATE INDEX mail_attachments_hash ON mail_attachments (hash);`,
+		down: `DROP INDEX mail_attachments_hash;`},
+	{version: 15, name: "scheduled_unlink_attachments_trigger",
+		stmt: `CREATE TRIGGER scheduled_unlink_attachments AFTER DELETE ON scheduled
+		BEGIN
+			DELETE FROM mail_attachments WHERE idem_key = old.idem_key;
+		END;`,
+		down: `DROP TRIGGER scheduled_unlink_attachments;`},
+	{version: 16, name: "move_attachments",
+		apply: moveAttachments},
+	{version: 17, name: "scheduled_drop_attachments",
+		stmt: `ALTER TABLE scheduled DROP COLUMN attachments;`},
+	{version: 18, name: "scheduled_finished_at",
+		stmt: `ALTER TABLE scheduled ADD COLUMN finished_at BIGINT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN finished_at;`},
+	{version: 19, name: "scheduled_provider_id",
+		stmt: `ALTER TABLE scheduled ADD COLUMN provider_id TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN provider_id;`},
+	{version: 20, name: "scheduled_recipient_hash",
+		stmt: `ALTER TABLE scheduled ADD COLUMN recipient_hash TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN recipient_hash;`},
+	{version: 21, name: "scheduled_stripped_at",
+		stmt: `ALTER TABLE scheduled ADD COLUMN stripped_at BIGINT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN stripped_at;`},
+	{version: 22, name: "scheduled_key_id",
+		stmt: `ALTER TABLE scheduled ADD COLUMN key_id TEXT;`,
+		undo: dropKeyID("scheduled")},
+	{version: 23, name: "attachments_key_id",
+		stmt: `ALTER TABLE attachments ADD COLUMN key_id TEXT;`,
+		undo: dropKeyID("attachments")},
+	{version: 24, name: "scheduled_last_error",
+		stmt: `ALTER TABLE scheduled ADD COLUMN last_error TEXT;`,
+		down: `ALTER TABLE scheduled DROP COLUMN last_error;`},
+	{version: 25, name: "create_audit_log",
+		stmt: `CREATE TABLE audit_log
+		(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at BIGINT NOT NULL,
+			client TEXT NOT NULL,
+			remote_addr TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			target_key TEXT NOT NULL,
+			count INT NOT NULL
+		);`,
+		down: `DROP TABLE audit_log;`},
+	{version: 26, name: "audit_log_at_index",
+		stmt: `CREATE INDEX audit_log_at ON audit_log (at);`,
+		down: `DROP INDEX audit_log_at;`},
+	{version: 27, name: "audit_log_no_update_trigger",
+		stmt: `CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_log is append-only');
+		END;`,
+		down: `DROP TRIGGER audit_log_no_update;`},
+	{version: 28, name: "audit_log_no_delete_trigger",
+		stmt: `CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_log is append-only');
+		END;`,
+		down: `DROP TRIGGER audit_log_no_delete;`},
+	{version: 29, name: "scheduled_error_key_id",
+		stmt: `ALTER TABLE scheduled ADD COLUMN error_key_id TEXT;`,
+		undo: dropKeyColumn("scheduled", "error_key_id")},
+}
+
+/* A fingerprint of what a migration does. Whitespace doesn't count;
+ * for a func all we have to go on is its name. */
+func (m *dbMigration) checksum() string {
+	body := strings.Join(strings.Fields(m.stmt), " ")
+	if m.apply != nil {
+		body = "func:" + m.name
+	}
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *dbMigration) canUndo() bool {
+	return m.down != "" || m.undo != nil
+}
+
+func findMigration(version int) *dbMigration {
+	for i := range db_migrations {
+		if db_migrations[i].version == version {
+			return &db_migrations[i]
+		}
+	}
+	return nil
+}
+
+/* Create the bookkeeping tables if need be. Databases from before
+ * schema_migrations kept an index into the list of migrations in
+ * db_metadata; carry that over. */
+func setupTables(db *sqlx.DB) error {
+	for _, quer := range db_setup_exec {
+		if _, err := db.Exec(quer); err != nil {
+			return err
+		}
+	}
+
+	var index int
+	err := db.Get(&index, `SELECT value FROM db_metadata WHERE key = 'migrations'`)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if index >= len(db_migrations) {
+		return fmt.Errorf("Saved migration %d > proposed list %d", index, len(db_migrations) - 1)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Unix()
+	for _, m := range db_migrations[:index + 1] {
+		stmt := `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`
+		if _, err = tx.Exec(stmt, m.version, m.name, m.checksum(), now); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM db_metadata WHERE key = 'migrations'`); err != nil {
+		return err
+	}
+
+	slog.Info("Carried over migrations to schema_migrations", "count", index + 1)
+	return tx.Commit()
+}
+
+func openDatabase(dBConn string) (db *sqlx.DB, err error) {
+	db, err = sqlx.Open("sqlite3", dBConn)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Every connection to :memory: gets its own, empty, database */
+	if dBConn == ":memory:" {
+		db.SetMaxOpenConns(1)
+	} else {
+		db.SetMaxIdleConns(8)
+		db.SetMaxOpenConns(8)
+	}
+
+	if err = setupTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+/* Open the database and bring it up to date */
+func initDatabase(dBConn string) (db *sqlx.DB, err error) {
+	db, err = openDatabase(dBConn)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := migrateUp(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if count > 0 {
+		slog.Info("Rolled database forward", "migrations", count)
+	}
+	return db, nil
+}
+
+/* Where one migration stands against the database */
+type MigrationStatus struct {
+	Version int
+	Name string
+	/* applied, pending, edited (applied, but changed since) or unknown
+	 * (applied, but not one of ours: the database is newer than we are) */
+	State string
+	AppliedAt time.Time
+	CanUndo bool
+}
+
+type appliedMigration struct {
+	Version int `db:"version"`
+	Name string `db:"name"`
+	Checksum string `db:"checksum"`
+	AppliedAt int64 `db:"applied_at"`
+}
+
+func schemaVersion(db *sqlx.DB) (int, error) {
+	var version int
+	err := db.Get(&version, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	return version, err
+}
+
+func migrationStatus(db *sqlx.DB) ([]MigrationStatus, error) {
+	var applied []appliedMigration
+	err := db.Select(&applied, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]appliedMigration, len(applied))
+	for _, a := range applied {
+		byVersion[a.Version] = a
+	}
+
+	var status []MigrationStatus
+	for i := range db_migrations {
+		m := &db_migrations[i]
+		s := MigrationStatus{ Version: m.version, Name: m.name, State: "pending", CanUndo: m.canUndo() }
+		if a, ok := byVersion[m.version]; ok {
+			s.State = "applied"
+			if a.Checksum != m.checksum() {
+				s.State = "edited"
+			}
+			s.AppliedAt = time.Unix(a.AppliedAt, 0)
+			delete(byVersion, m.version)
+		}
+		status = append(status, s)
+	}
+
+	for _, a := range byVersion {
+		status = append(status, MigrationStatus{
+			Version: a.Version,
+			Name: a.Name,
+			State: "unknown",
+			AppliedAt: time.Unix(a.AppliedAt, 0),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return status, nil
+}
+
+/* Apply every pending migration, in order, each in its own transaction */
+func migrateUp(db *sqlx.DB) (int, error) {
+	status, err := migrationStatus(db)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range status {
+		switch s.State {
+		case "unknown":
+			return 0, fmt.Errorf("Database has migration %d (%s), which we don't know about. Is it from a newer mailer?", s.Version, s.Name)
+		case "edited":
+			slog.Warn("Migration has changed since it was applied", "version", s.Version, "name", s.Name)
+		}
+	}
+
+	count := 0
+	for _, s := range status {
+		if s.State != "pending" {
+			continue
+		}
+
+		m := findMigration(s.Version)
+		slog.Info("Applying migration", "version", m.version, "name", m.name)
+		if err = runMigration(db, m.version, func(tx *sqlx.Tx) error {
+			if m.apply != nil {
+				return m.apply(tx)
+			}
+			_, err := tx.Exec(m.stmt)
+			return err
+		}, func(tx *sqlx.Tx) error {
+			stmt := `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`
+			_, err := tx.Exec(stmt, m.version, m.name, m.checksum(), time.Now().UTC().Unix())
+			return err
+		}); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+/* Roll back the last steps migrations applied. Stops at the first one
+ * that can't be undone. */
+func migrateDown(db *sqlx.DB, steps int) (int, error) {
+	var versions []int
+	stmt := `SELECT version FROM schema_migrations ORDER BY version DESC LIMIT ?`
+	if err := db.Select(&versions, stmt, steps); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, version := range versions {
+		m := findMigration(version)
+		if m == nil {
+			return count, fmt.Errorf("Can't undo migration %d, we don't know about it", version)
+		}
+		if !m.canUndo() {
+			return count, fmt.Errorf("Migration %d (%s) can't be undone", m.version, m.name)
+		}
+
+		slog.Info("Undoing migration", "version", m.version, "name", m.name)
+		if err := runMigration(db, m.version, func(tx *sqlx.Tx) error {
+			if m.undo != nil {
+				return m.undo(tx)
+			}
+			_, err := tx.Exec(m.down)
+			return err
+		}, func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+			return err
+		}); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+/* Make a change to the schema and record it, together or not at all */
+func runMigration(db *sqlx.DB, version int, change func(tx *sqlx.Tx) error, record func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = change(tx); err != nil {
+		return fmt.Errorf("migration %d failed: %s", version, err)
+	}
+	if err = record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* For looking after the schema by hand. Unlike SQLiteStoreNew,
+ * opening one doesn't apply anything. */
+type Migrator struct {
+	db *sqlx.DB
+}
+
+func MigratorNew(dbConn string) (*Migrator, error) {
+	db, err := openDatabase(dbConn)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{ db: db }, nil
+}
+
+func (mg *Migrator) Status() ([]MigrationStatus, error) {
+	return migrationStatus(mg.db)
+}
+
+func (mg *Migrator) Up() (int, error) {
+	return migrateUp(mg.db)
+}
+
+func (mg *Migrator) Down(steps int) (int, error) {
+	return migrateDown(mg.db, steps)
+}
+
+/* Switch the database to incremental vacuuming, so purging can give
+ * space back as it goes. It takes a full VACUUM, which rewrites the
+ * whole file and locks it while it does, so it's only done when asked.
+ * Returns false if it was switched already */
+func (mg *Migrator) EnableIncrementalVacuum() (bool, error) {
+	/* PRAGMAs are per connection, so stick to one */
+	conn, err := mg.db.Connx(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err = conn.GetContext(context.Background(), &mode, `PRAGMA auto_vacuum`); err != nil {
+		return false, err
+	}
+	/* 2 is INCREMENTAL */
+	if mode == 2 {
+		return false, nil
+	}
+
+	if _, err = conn.ExecContext(context.Background(), `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+		return false, err
+	}
+	_, err = conn.ExecContext(context.Background(), `VACUUM`)
+	return err == nil, err
+}
+
+func (mg *Migrator) Close() error {
+	return mg.db.Close()
+}
+
+/* Without key_id we couldn't tell what's encrypted, so only drop it
+ * once nothing is */
+func dropKeyID(table string) func(tx *sqlx.Tx) error {
+	return dropKeyColumn(table, "key_id")
+}
+
+func dropKeyColumn(table string, col string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		var count int
+		err := tx.Get(&count, fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s IS NOT NULL`, table, col))
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%d rows in %s are still encrypted", count, table)
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s DROP COLUMN %s;`, table, col))
+		return err
+	}
+}
+
+/* Idem keys used to be a hash of the job key, address and title run
+ * together, which let different mails collide. Rekey every mail still
+ * under its old derived key; anything else (an edited title, say) keeps
+ * the key it has. */
+func rekeyIdemKeys(tx *sqlx.Tx) error {
+	type keyed struct {
+		IdemKey string `db:"idem_key"`
+		JobKey string `db:"job_key"`
+		ToAddr string `db:"to_addr"`
+		Title string `db:"title"`
+	}
+
+	var mails []keyed
+	err := tx.Select(&mails, `SELECT idem_key, job_key, to_addr, title FROM scheduled`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mails {
+		h := sha256.New()
+		h.Write([]byte(m.JobKey))
+		h.Write([]byte(m.ToAddr))
+		h.Write([]byte(m.Title))
+		if m.IdemKey != hex.EncodeToString(h.Sum(nil)) {
+			continue
+		}
+
+		newKey := deriveIdemKey(m.JobKey, m.ToAddr, m.Title)
+		_, err = tx.Exec(`UPDATE scheduled SET idem_key = ? WHERE idem_key = ?`, newKey, m.IdemKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Attachments used to be stored inline on every mail; move them out
+ * to the attachments table, where each is stored once by its hash.
+ * Written against the tables as they were at version 16, not the
+ * helpers the datastore uses now */
+func moveAttachments(tx *sqlx.Tx) error {
+	type inline struct {
+		IdemKey string `db:"idem_key"`
+		Attachments AttachSet `db:"attachments"`
+	}
+
+	var mails []inline
+	err := tx.Select(&mails, `SELECT idem_key, attachments FROM scheduled WHERE attachments IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Unix()
+	for _, m := range mails {
+		for i, a := range m.Attachments {
+			data, err := a.Value()
+			if err != nil {
+				return err
+			}
+
+			hash := a.Hash()
+			stmt := `INSERT INTO attachments (hash, data, size, uploaded_at) VALUES (?, ?, ?, ?)
+				ON CONFLICT (hash) DO NOTHING`
+			if _, err = tx.Exec(stmt, hash, data, len(data.([]byte)), now); err != nil {
+				return err
+			}
+
+			stmt = `INSERT INTO mail_attachments (idem_key, seq, hash) VALUES (?, ?, ?)`
+			if _, err = tx.Exec(stmt, m.IdemKey, i, hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package mail
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* What to do when an attachment's bytes say it's something other than
+ * what it was declared as */
+const (
+	MismatchOverride = "override"
+	MismatchReject = "reject"
+)
+
+/* What attachments a mail can have. Sizes of 0 aren't limited; an
+ * empty Allow allows any type that isn't in Deny. Types are matched
+ * without their parameters, and can be given as "image/*" */
+type AttachmentPolicy struct {
+	/* An attachment's size, as it is */
+	MaxAttachmentBytes int64
+	/* The bodies plus the attachments once base64'd, which is roughly
+	 * what providers count against their limit */
+	MaxMessageBytes int64
+	Allow []string
+	Deny []string
+	Mismatch string
+}
+
+/* Mailgun takes messages of up to 25MB (SendGrid 30MB) */
+func DefaultAttachmentPolicy() *AttachmentPolicy {
+	return &AttachmentPolicy{
+		MaxAttachmentBytes: 10 << 20,
+		MaxMessageBytes: 25 << 20,
+		Mismatch: MismatchOverride,
+	}
+}
+
+/* Comma separated types, as they come from the env */
+func ParseTypeList(list string) ([]string, error) {
+	var types []string
+	for _, typ := range strings.Split(list, ",") {
+		typ = strings.ToLower(strings.TrimSpace(typ))
+		if typ == "" {
+			continue
+		}
+		major, minor, ok := strings.Cut(typ, "/")
+		if !ok || major == "" || minor == "" || strings.Contains(minor, "/") {
+			return nil, fmt.Errorf("%s isn't a content type", typ)
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+/* What a new mail's attachments can unzip to: no more than fits in a
+ * message. A nil policy holds them to no more than anything else */
+func (p *AttachmentPolicy) attachBudget() *attachBudget {
+	if p != nil && p.MaxMessageBytes > 0 {
+		return newAttachBudget(p.MaxMessageBytes)
+	}
+	return newAttachBudget(maxAttachmentSetTLV)
+}
+
+/* How big a request body to read: the biggest message, with room
+ * for the JSON around it. 0 is no limit */
+func (p *AttachmentPolicy) MaxRequestBytes() int64 {
+	if p.MaxMessageBytes == 0 {
+		return 0
+	}
+	return p.MaxMessageBytes + (1 << 20)
+}
+
+/* Hold a newly requested mail to p, attachments it refers to
+ * included. Better to refuse it now than have the provider refuse it
+ * later. Imports aren't held to it: they were let in under whatever
+ * policy there was at the time */
+func CheckRequest(ds Datastore, p *AttachmentPolicy, m *Mail) error {
+	refs, err := ds.GetAttachments(m.AttachmentRefs)
+	if err != nil {
+		return err
+	}
+	return p.CheckMail(m, refs)
+}
+
+/* Check a mail's attachments, fixing up the names and types of the
+ * inline ones as we go; refs are the uploaded attachments it refers
+ * to, which are checked as they are. A mail that breaks the policy
+ * is refused. */
+func (p *AttachmentPolicy) CheckMail(m *Mail, refs AttachSet) error {
+	if err := p.CheckAttachments(m.Attachments); err != nil {
+		return err
+	}
+	for _, a := range refs {
+		if err := p.checkUploaded(a); err != nil {
+			return err
+		}
+	}
+
+	size := int64(len(m.HTMLBody) + len(m.TextBody)) + encodedSize(m.Attachments) + encodedSize(refs)
+	if p.MaxMessageBytes > 0 && size > p.MaxMessageBytes {
+		return fmt.Errorf("Mail is %d bytes with its attachments encoded, limit %d", size, p.MaxMessageBytes)
+	}
+	return nil
+}
+
+/* Check a set of attachments on their own, as for an edit */
+func (p *AttachmentPolicy) CheckAttachments(as AttachSet) error {
+	for _, a := range as {
+		if err := p.CheckAttachment(a); err != nil {
+			return err
+		}
+	}
+
+	size := encodedSize(as)
+	if p.MaxMessageBytes > 0 && size > p.MaxMessageBytes {
+		return fmt.Errorf("Attachments are %d bytes encoded, limit %d", size, p.MaxMessageBytes)
+	}
+	return nil
+}
+
+func (p *AttachmentPolicy) CheckAttachment(a *Attachment) error {
+	a.Name = SanitizeFilename(a.Name)
+
+	if p.MaxAttachmentBytes > 0 && int64(len(a.Content)) > p.MaxAttachmentBytes {
+		return fmt.Errorf("Attachment %s is %d bytes, limit %d", a.Name, len(a.Content), p.MaxAttachmentBytes)
+	}
+
+	/* Octet-stream is what clients say when they don't know */
+	if strings.TrimSpace(a.Type) == "" || baseType(a.Type) == "application/octet-stream" {
+		a.Type = SniffType(a.Name, a.Content)
+	} else if _, _, err := mime.ParseMediaType(a.Type); err != nil {
+		return fmt.Errorf("Attachment %s type %s: %s", a.Name, a.Type, err)
+	}
+
+	/* Don't take the declared type on faith */
+	if sniffed := http.DetectContentType(a.Content); !typesAgree(a.Type, sniffed) {
+		if p.Mismatch == MismatchReject {
+			return fmt.Errorf("Attachment %s is declared %s, but looks like %s", a.Name, a.Type, sniffed)
+		}
+		a.Type = sniffed
+	}
+
+	typ := baseType(a.Type)
+	if matchType(p.Deny, typ) {
+		return fmt.Errorf("Attachment %s is %s, which isn't allowed", a.Name, typ)
+	}
+	if len(p.Allow) > 0 && !matchType(p.Allow, typ) {
+		return fmt.Errorf("Attachment %s is %s, which isn't allowed", a.Name, typ)
+	}
+	return nil
+}
+
+/* An uploaded attachment was cleaned up when it came in, and changing
+ * it now would change its hash; it only has to still be allowed */
+func (p *AttachmentPolicy) checkUploaded(a *Attachment) error {
+	if p.MaxAttachmentBytes > 0 && int64(len(a.Content)) > p.MaxAttachmentBytes {
+		return fmt.Errorf("Attachment %s is %d bytes, limit %d", a.Name, len(a.Content), p.MaxAttachmentBytes)
+	}
+
+	typ := baseType(a.Type)
+	if matchType(p.Deny, typ) {
+		return fmt.Errorf("Attachment %s is %s, which isn't allowed", a.Name, typ)
+	}
+	if len(p.Allow) > 0 && !matchType(p.Allow, typ) {
+		return fmt.Errorf("Attachment %s is %s, which isn't allowed", a.Name, typ)
+	}
+	return nil
+}
+
+/* What the attachments come to once base64'd into a MIME message */
+func encodedSize(as AttachSet) int64 {
+	var size int64
+	for _, a := range as {
+		size += int64(len(a.Content) + 2) / 3 * 4
+	}
+	return size
+}
+
+/* The media type, lower case and without its parameters */
+func baseType(typ string) string {
+	if base, _, err := mime.ParseMediaType(typ); err == nil {
+		typ = base
+	}
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if alias, ok := typeAliases[typ]; ok {
+		return alias
+	}
+	return typ
+}
+
+func matchType(types []string, typ string) bool {
+	major, _, _ := strings.Cut(typ, "/")
+	for _, t := range types {
+		if t == typ || t == major + "/*" || baseType(t) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+/* Other names for types http.DetectContentType knows */
+var typeAliases = map[string]string{
+	"image/jpg": "image/jpeg",
+	"image/pjpeg": "image/jpeg",
+	"image/vnd.microsoft.icon": "image/x-icon",
+	"audio/wav": "audio/wave",
+	"audio/x-wav": "audio/wave",
+	"audio/mp3": "audio/mpeg",
+	"audio/x-aiff": "audio/aiff",
+	"video/x-msvideo": "video/avi",
+	"application/gzip": "application/x-gzip",
+	"application/x-zip-compressed": "application/zip",
+	"application/vnd.rar": "application/x-rar-compressed",
+	"application/x-font-ttf": "font/ttf",
+}
+
+/* The types http.DetectContentType can recognise from their bytes.
+ * Declare one of these and the bytes had better match */
+var sniffableTypes = map[string]bool{
+	"image/x-icon": true, "image/bmp": true, "image/gif": true,
+	"image/webp": true, "image/png": true, "image/jpeg": true,
+	"audio/basic": true, "audio/aiff": true, "audio/mpeg": true,
+	"application/ogg": true, "audio/midi": true, "video/avi": true,
+	"audio/wave": true, "video/mp4": true, "video/webm": true,
+	"font/ttf": true, "font/otf": true, "font/collection": true,
+	"font/woff": true, "font/woff2": true, "application/vnd.ms-fontobject": true,
+	"application/x-gzip": true, "application/zip": true,
+	"application/x-rar-compressed": true, "application/wasm": true,
+	"application/pdf": true, "application/postscript": true,
+}
+
+/* Whether the declared type squares with what the content sniffed as.
+ * The sniffer only knows so much: unknown bytes and text could be any
+ * of a lot of things, and a zip could be an office document */
+func typesAgree(declared string, sniffed string) bool {
+	declared, sniffed = baseType(declared), baseType(sniffed)
+	if declared == sniffed {
+		return true
+	}
+
+	switch {
+	case sniffed == "application/octet-stream", strings.HasPrefix(sniffed, "text/"):
+		return !sniffableTypes[declared]
+	case sniffed == "application/zip":
+		return strings.HasPrefix(declared, "application/vnd.") ||
+			strings.HasSuffix(declared, "+zip") ||
+			declared == "application/java-archive"
+	case sniffed == "application/ogg", sniffed == "video/mp4", sniffed == "video/webm":
+		/* Containers, for sound as much as pictures */
+		return strings.HasPrefix(declared, "audio/") || strings.HasPrefix(declared, "video/")
+	}
+	return false
+}
+
+/* A filename that's safe to hand a mail client: no directories,
+ * nothing unprintable, nothing Windows chokes on, and not too long */
+func SanitizeFilename(name string) string {
+	/* Whichever way its slashes lean */
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+
+	/* Most filesystems stop at 255 bytes; keep the extension */
+	const maxName = 255
+	if len(name) > maxName {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxName - len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem) - 1]
+		}
+		name = stem + ext
+	}
+
+	if name == "" {
+		return "attachment"
+	}
+	return name
+}
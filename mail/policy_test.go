@@ -0,0 +1,230 @@
+package mail
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	tt "testing"
+	"time"
+)
+
+func TestSanitizeFilename(t *tt.T) {
+	names := []struct {
+		name string
+		exp string
+	}{
+		{ "invoice.pdf", "invoice.pdf" },
+		{ "../../etc/passwd", "passwd" },
+		{ `C:\Users\me\report.docx`, "report.docx" },
+		{ "bad\x00name\r\n.txt", "badname.txt" },
+		{ "what?<is>|this*.txt", "what__is__this_.txt" },
+		{ "\u202egnp.exe", "gnp.exe" },
+		{ " .hidden. ", "hidden" },
+		{ "..", "attachment" },
+		{ "", "attachment" },
+		{ strings.Repeat("é", 200) + ".pdf", strings.Repeat("é", 125) + ".pdf" },
+	}
+	for _, n := range names {
+		if got := SanitizeFilename(n.name); got != n.exp {
+			t.Errorf("expecting %q for %q, got %q", n.exp, n.name, got)
+		}
+	}
+}
+
+func TestAttachmentPolicy(t *tt.T) {
+	pdf := []byte("%PDF-1.4 and so on")
+	zip := []byte("PK\x03\x04 and so on")
+
+	p := &AttachmentPolicy{
+		MaxAttachmentBytes: 100,
+		MaxMessageBytes: 200,
+		Deny: []string{ "application/zip" },
+		Mismatch: MismatchOverride,
+	}
+
+	checks := []struct {
+		a Attachment
+		typ string
+		ok bool
+	}{
+		{ Attachment{ Name: "a.pdf", Type: "application/pdf", Content: pdf }, "application/pdf", true },
+		/* Not knowing, or saying octet-stream, gets it sniffed */
+		{ Attachment{ Name: "a", Content: pdf }, "application/pdf", true },
+		{ Attachment{ Name: "a", Type: "application/octet-stream", Content: pdf }, "application/pdf", true },
+		/* Claims to be something it isn't */
+		{ Attachment{ Name: "a.png", Type: "image/png", Content: []byte("hello") }, "text/plain; charset=utf-8", true },
+		{ Attachment{ Name: "a.txt", Type: "text/plain", Content: pdf }, "application/pdf", true },
+		/* What the sniffer can't tell apart */
+		{ Attachment{ Name: "a.csv", Type: "text/csv", Content: []byte("a,b") }, "text/csv", true },
+		{ Attachment{ Name: "a.docx", Type: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Content: zip },
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document", true },
+		{ Attachment{ Name: "a.jpg", Type: "image/jpg", Content: []byte("\xff\xd8\xff") }, "image/jpg", true },
+		/* Denied, however it's dressed up */
+		{ Attachment{ Name: "a.zip", Type: "application/zip", Content: zip }, "", false },
+		{ Attachment{ Name: "a.txt", Type: "text/plain", Content: zip }, "", false },
+		{ Attachment{ Name: "a.txt", Type: "text/plain", Content: make([]byte, 101) }, "", false },
+		{ Attachment{ Name: "a.txt", Type: "text/", Content: pdf }, "", false },
+	}
+	for _, c := range checks {
+		a := c.a
+		err := p.CheckAttachment(&a)
+		if c.ok && err != nil {
+			t.Errorf("%s: was not expecting err %s", c.a.Name, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: was expecting err", c.a.Name)
+		} else if c.ok && a.Type != c.typ {
+			t.Errorf("%s: expecting type %s, got %s", c.a.Name, c.typ, a.Type)
+		}
+	}
+
+	p.Mismatch = MismatchReject
+	if err := p.CheckAttachment(&Attachment{ Name: "a.png", Type: "image/png", Content: []byte("hello") }); err == nil {
+		t.Errorf("was expecting err for a mismatched type")
+	}
+
+	p.Allow = []string{ "image/*", "text/plain" }
+	for typ, ok := range map[string]bool{ "image/gif": true, "text/plain": true, "text/csv": false, "application/pdf": false } {
+		content := []byte("GIF89a")
+		if typ == "application/pdf" {
+			content = pdf
+		} else if !strings.HasPrefix(typ, "image/") {
+			content = []byte("hi")
+		}
+		err := p.CheckAttachment(&Attachment{ Name: "a", Type: typ, Content: content })
+		if ok != (err == nil) {
+			t.Errorf("%s: expecting allowed %t, got %v", typ, ok, err)
+		}
+	}
+
+	/* The cap on the whole message, at schedule time */
+	p = &AttachmentPolicy{ MaxAttachmentBytes: 100, MaxMessageBytes: 200 }
+	job := MailRequest{
+		JobKey: "course",
+		ToAddr: "hi@example.com",
+		Title: "Hi",
+		TextBody: "hi",
+		Attachments: AttachSet{
+			{ Name: "../one.txt", Type: "text/plain", Content: make([]byte, 60) },
+			{ Name: "two.txt", Type: "text/plain", Content: make([]byte, 60) },
+		},
+	}
+	ds := MemStoreNew()
+	m, err := ConvertMailRequest(job)
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	if err = CheckRequest(ds, p, m); err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	if m.Attachments[0].Name != "one.txt" {
+		t.Errorf("expecting the name cleaned up, got %s", m.Attachments[0].Name)
+	}
+
+	/* Uploaded attachments count just the same */
+	hash, err := ds.PutAttachment(&Attachment{ Name: "three.txt", Type: "text/plain", Content: make([]byte, 60) })
+	if err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	job.AttachmentRefs = []string{ hash }
+	if m, err = ConvertMailRequest(job); err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	if err = CheckRequest(ds, p, m); err == nil {
+		t.Errorf("was expecting err for a mail over the limit")
+	}
+
+	job.Attachments = job.Attachments[:1]
+	if m, err = ConvertMailRequest(job); err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+	if err = CheckRequest(ds, p, m); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+
+	/* And have to still be allowed */
+	p = &AttachmentPolicy{ Deny: []string{ "text/*" } }
+	if err = CheckRequest(ds, p, &Mail{ AttachmentRefs: []string{ hash } }); err == nil {
+		t.Errorf("was expecting err for a type that isn't allowed")
+	}
+	if err = CheckRequest(ds, p, &Mail{ AttachmentRefs: []string{ "deadbeef" } }); err == nil {
+		t.Errorf("was expecting err for an unknown attachment")
+	}
+
+	/* Imports were let in under the policy of their day */
+	imported, err := ConvertMailExport(*ExportMail(m))
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	} else if imported.Attachments[0].Name != "one.txt" {
+		t.Errorf("expecting the import to keep its attachment, got %s", imported.Attachments[0].Name)
+	}
+}
+
+func TestRequestLimit(t *tt.T) {
+	routes := SetupRoutes(MemStoreNew(), "secret", "", &AttachmentPolicy{ MaxMessageBytes: 1000 }, NewWaker(), nil, nil)
+
+	body := `{"job_key": "course", "to_addr": "hi@example.com", "title": "Hi", "send_at": 1, "text_body": "` +
+		strings.Repeat("x", 2 << 20) + `"}`
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, signedRequest("secret", "PUT", "/job", body))
+	var ret ReturnVal
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if ret.Success {
+		t.Errorf("expecting a body over the limit to be refused")
+	}
+}
+
+/* An edit is held to the cap on the whole message, as the mail
+ * would be after it */
+func TestEditLimit(t *tt.T) {
+	ds := MemStoreNew()
+	routes := SetupRoutes(ds, "secret", "", &AttachmentPolicy{ MaxMessageBytes: 1000 }, NewWaker(), nil, nil)
+
+	var keys []string
+	for _, addr := range []string{ "a@example.com", "b@example.com" } {
+		m := &Mail{
+			JobKey: "course",
+			Missive: sql.NullString{ String: "week-1", Valid: true },
+			ToAddr: addr,
+			Title: "Hi",
+			TextBody: "hi",
+			SendAt: Timestamp(time.Now()),
+		}
+		if err := ds.ScheduleMail(m); err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		keys = append(keys, m.IdemKey())
+	}
+	hash, _ := ds.PutAttachment(&Attachment{ Name: "big.txt", Type: "text/plain", Content: make([]byte, 900) })
+
+	patch := func(path string, body string) *ReturnVal {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, signedRequest("secret", "PATCH", path, body))
+		var ret ReturnVal
+		if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+			t.Errorf("was not expecting err %s", err)
+		}
+		return &ret
+	}
+
+	edits := map[string]bool{
+		`{"text_body": "` + strings.Repeat("x", 2000) + `"}`: false,
+		`{"attachment_refs": ["` + hash + `"]}`: false,
+		`{"attachment_refs": ["deadbeef"]}`: false,
+		`{"text_body": "hello"}`: true,
+	}
+	for body, ok := range edits {
+		for _, path := range []string{ "/mail/" + keys[0], "/missive/week-1" } {
+			if ret := patch(path, body); ret.Success != ok {
+				t.Errorf("%s: expecting success %t, got %s", path, ok, ret.Message)
+			}
+		}
+	}
+
+	m, _ := ds.GetMail(keys[1])
+	if m.TextBody != "hello" || len(m.Attachments) != 0 {
+		t.Errorf("expecting only the edit that fit, got %d bytes of text with %d attachments", len(m.TextBody), len(m.Attachments))
+	}
+}
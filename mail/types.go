@@ -6,11 +6,18 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"io/ioutil"
@@ -20,8 +27,12 @@ type (
 
 	AttachSet []*Attachment
 	Timestamp time.Time
+	Priority int
 
 	MailRequest struct {
+		/* Optional; if left off, one's derived
+		 * from the job key, address and title */
+		IdempotencyKey string `json:"idempotency_key,omitempty"`
 		JobKey string `json:"job_key"`
 		Subscription string `json:"subscription,omitempty"`
 		Missive     string   `json:"missive,omitempty"`
@@ -34,14 +45,99 @@ type (
 		HTMLBody string `json:"html_body"`
 		TextBody string `json:"text_body"`
 		Attachments AttachSet `json:"attachments,omitempty"`
+		/* Hashes of attachments already uploaded to /attachment */
+		AttachmentRefs []string `json:"attachment_refs,omitempty"`
 		SendAt float64 `json:"send_at"`
 		Domain string  `json:"mail_domain"`
+		Priority Priority `json:"priority,omitempty"`
+		/* Don't send after this; either a unix time, or
+		 * a number of seconds after send_at */
+		ExpiresAt float64 `json:"expires_at,omitempty"`
+		ExpiresIn float64 `json:"expires_in,omitempty"`
+	}
+
+	/* A line of an export: the mail as it would be sent up,
+	 * under its idem key, plus how far it's got */
+	MailExport struct {
+		MailRequest
+		State ScheduleState `json:"state"`
+		TryCount int `json:"try_count,omitempty"`
+		ProviderID string `json:"provider_id,omitempty"`
+	}
+
+	/* Which mails to look at. Blank fields match everything;
+	 * the dates are on send_at, from inclusive, to exclusive */
+	MailFilter struct {
+		State ScheduleState
+		JobKey string
+		Missive string
+		SendFrom time.Time
+		SendTo time.Time
+	}
+
+	/* How much mail is where, as of a moment */
+	QueueStats struct {
+		Counts []QueueCount
+		/* Mail due to have gone out that hasn't, and when the
+		 * longest-waiting of it came due (zero if there's none) */
+		Due int64
+		OldestDue time.Time
+	}
+
+	QueueCount struct {
+		State ScheduleState `db:"state"`
+		Domain string `db:"mail_domain"`
+		Count int64 `db:"count"`
+	}
+
+	/* How many mails a job (and missive) has in a state, or has
+	 * waiting to go out at a time; whichever was asked for */
+	MailCount struct {
+		JobKey string `db:"job_key"`
+		Missive sql.NullString `db:"missive"`
+		State ScheduleState `db:"state"`
+		SendAt int64 `db:"send_at"`
+		Count int64 `db:"count"`
+	}
+
+	/* A change made through the API (or the dashboard): what was
+	 * done, to which job, missive, mail etc, and how many mails it
+	 * touched. Who did it is whatever they signed X-Base58-Client as */
+	AuditEntry struct {
+		ID int64 `db:"id" json:"id"`
+		At int64 `db:"at" json:"at"`
+		Client string `db:"client" json:"client"`
+		RemoteAddr string `db:"remote_addr" json:"remote_addr"`
+		Action string `db:"action" json:"action"`
+		Target string `db:"target" json:"target"`
+		Key string `db:"target_key" json:"key"`
+		Count int64 `db:"count" json:"count"`
+	}
+
+	/* Which audit entries to look at. Blank fields match everything;
+	 * Since is inclusive, Until exclusive */
+	AuditFilter struct {
+		Client string
+		Action string
+		Key string
+		Since time.Time
+		Until time.Time
 	}
 
 	ReturnVal struct {
 		Success bool   `json:"success"`
 		Code int       `json:"code"`
 		Message string `json:"error,omitempty"`
+		Count int64    `json:"count,omitempty"`
+		IdemKey string `json:"idem_key,omitempty"`
+		Hash string `json:"hash,omitempty"`
+		Audit []*AuditEntry `json:"audit,omitempty"`
+		/* Pass as before= for the next page */
+		Next int64 `json:"next,omitempty"`
+	}
+
+	AttachmentUpload struct {
+		Attachment *Attachment `json:"attachment"`
 	}
 
 	JobDelete struct {
@@ -56,7 +152,30 @@ type (
 		Missive string `json:"missive"`
 	}
 
+	/* Which mails to pause or resume; only the key
+	 * for the endpoint being called is looked at */
+	PauseRequest struct {
+		JobKey string `json:"job_key,omitempty"`
+		SubKey string `json:"subscription,omitempty"`
+		Missive string `json:"missive,omitempty"`
+	}
+
+	/* Content changes for mail that's not gone out yet.
+	 * Fields left off are left as they are */
+	MailEdit struct {
+		Title *string `json:"title,omitempty"`
+		HTMLBody *string `json:"html_body,omitempty"`
+		TextBody *string `json:"text_body,omitempty"`
+		Attachments *AttachSet `json:"attachments,omitempty"`
+		AttachmentRefs *[]string `json:"attachment_refs,omitempty"`
+		FromAddr *string `json:"from_addr,omitempty"`
+		FromName *string `json:"from_name,omitempty"`
+		ReplyTo *string `json:"reply_to,omitempty"`
+	}
+
 	Mail struct {
+		/* Set by the client, or else once the mail's been saved */
+		Idem string `db:"idem_key"`
 		JobKey string `db:"job_key"`
 		Sub    sql.NullString `db:"sub"`
 		Missive sql.NullString `db:"missive"`
@@ -68,21 +187,104 @@ type (
 		Title string
 		HTMLBody string `db:"html_body"`
 		TextBody string `db:"text_body"`
-		Attachments AttachSet `db:"attachments"`
+		/* Attachments are stored apart from the mail, by hash */
+		Attachments AttachSet `db:"-"`
+		AttachmentRefs []string `db:"-"`
 		SendAt Timestamp `db:"send_at"`
 		State ScheduleState
 		TryCount int `db:"try_count"`
 		Domain string `db:"mail_domain"`
+		Priority Priority `db:"priority"`
+		ExpiresAt sql.NullInt64 `db:"expires_at"`
+		Revision int `db:"revision"`
+		/* What the provider called it, once sent */
+		ProviderID sql.NullString `db:"provider_id"`
+		/* Why the last try to send it failed, if it has */
+		LastError sql.NullString `db:"last_error"`
 	}
 
 	Attachment struct {
 		Content []byte
 		Type string
 		Name string
+		/* "inline" to show it in the body (by ContentID), rather
+		 * than as a file; blank is "attachment" */
+		Disposition string
+		ContentID string
+	}
+
+	/* An attachment as plain JSON, for clients that would rather
+	 * not build the TLV; it's unmarshalled into an Attachment */
+	AttachmentObject struct {
+		Filename string `json:"filename"`
+		ContentType string `json:"content_type,omitempty"`
+		ContentBase64 *string `json:"content_base64"`
+		Disposition string `json:"disposition,omitempty"`
+		ContentID string `json:"content_id,omitempty"`
 	}
 )
 
+/* Bounds on what we'll decode: how big an attachment can unzip to,
+ * and how many a mail can have */
+const maxAttachmentTLV = 64 << 20
+const maxAttachments = 100
+
+/* What a mail's attachments can unzip to, all told, when there's no
+ * message size to hold them to: imports, what's stored, and new mail
+ * under a policy without a cap */
+const maxAttachmentSetTLV = 256 << 20
+
+/* How much a mail's attachments can unzip to all told, and how much of
+ * that is left as they're decoded */
+type attachBudget struct {
+	total int64
+	left int64
+}
+
+func newAttachBudget(total int64) *attachBudget {
+	return &attachBudget{ total: total, left: total }
+}
+
+func (b *attachBudget) take(size int64) error {
+	if size > b.left {
+		return fmt.Errorf("Attachments unzip to more than %d bytes all told", b.total)
+	}
+	b.left -= size
+	return nil
+}
+
+/* Decode a MailRequest sent up to us. Its attachments have to fit in a
+ * message under p, so they can't unzip to more than that either */
+func DecodeMailRequest(data []byte, job *MailRequest, p *AttachmentPolicy) error {
+	return decodeMailRequestJSON(data, job, p.attachBudget())
+}
+
+func decodeMailRequestJSON(data []byte, job *MailRequest, budget *attachBudget) error {
+	type plain MailRequest
+	var req struct {
+		*plain
+		Attachments json.RawMessage `json:"attachments"`
+	}
+	req.plain = (*plain)(job)
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	job.Attachments = nil
+	if len(req.Attachments) == 0 || string(req.Attachments) == "null" {
+		return nil
+	}
+	return job.Attachments.unmarshalJSON(req.Attachments, budget)
+}
+
+/* Client keys end up in URL paths, so keep them to something tame */
+var idempotencyKeyRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
 func ConvertMailRequest(job MailRequest) (*Mail, error) {
+	if job.IdempotencyKey != "" && !idempotencyKeyRe.MatchString(job.IdempotencyKey) {
+		return nil, fmt.Errorf("idempotency_key must be 1-128 characters of A-Z, a-z, 0-9, '.', '_', ':' or '-'")
+	}
+
 	m := &Mail{
 		JobKey: job.JobKey,
 		Sub:    sql.NullString{
@@ -114,23 +316,240 @@ func ConvertMailRequest(job MailRequest) (*Mail, error) {
 		HTMLBody: job.HTMLBody,
 		TextBody: job.TextBody,
 		Attachments: job.Attachments,
+		AttachmentRefs: job.AttachmentRefs,
 		SendAt: Timestamp(time.Unix(int64(job.SendAt), 0)),
 		Domain: job.Domain,
+		Priority: job.Priority,
+	}
+
+	/* Client keys are only unique to the client's job, so scope them
+	 * to it. Keys that clients don't pick are derived from three
+	 * fields, which can't collide with these two */
+	if job.IdempotencyKey != "" {
+		m.Idem = deriveIdemKey(job.JobKey, job.IdempotencyKey)
 	}
 
 	if m.HTMLBody == "" && m.TextBody == "" {
 		return nil, fmt.Errorf("Must provide either html_body or text_body")
 	}
 
+	if job.ExpiresAt != 0 && job.ExpiresIn != 0 {
+		return nil, fmt.Errorf("Provide only one of expires_at or expires_in")
+	}
+	if job.ExpiresIn < 0 {
+		return nil, fmt.Errorf("expires_in must be positive")
+	}
+	expiresAt := job.ExpiresAt
+	if job.ExpiresIn != 0 {
+		expiresAt = job.SendAt + job.ExpiresIn
+	}
+	if expiresAt != 0 {
+		if expiresAt <= job.SendAt {
+			return nil, fmt.Errorf("expires_at must be after send_at")
+		}
+		m.ExpiresAt = sql.NullInt64{
+			Valid: true,
+			Int64: int64(expiresAt),
+		}
+	}
+
+	return m, nil
+}
+
+/* The mail as an export line. Unlike a MailRequest sent up to us, it
+ * carries its idem key even if it was derived. */
+func ExportMail(m *Mail) *MailExport {
+	e := &MailExport{
+		MailRequest: MailRequest{
+			IdempotencyKey: m.IdemKey(),
+			JobKey: m.JobKey,
+			Subscription: m.Sub.String,
+			Missive: m.Missive.String,
+			ToAddr: m.ToAddr,
+			ToName: m.ToName.String,
+			FromAddr: m.FromAddr.String,
+			FromName: m.FromName.String,
+			ReplyTo: m.ReplyTo.String,
+			Title: m.Title,
+			HTMLBody: m.HTMLBody,
+			TextBody: m.TextBody,
+			Attachments: m.Attachments,
+			SendAt: float64(time.Time(m.SendAt).Unix()),
+			Domain: m.Domain,
+			Priority: m.Priority,
+		},
+		State: m.State,
+		TryCount: m.TryCount,
+		ProviderID: m.ProviderID.String,
+	}
+	if m.ExpiresAt.Valid {
+		e.ExpiresAt = float64(m.ExpiresAt.Int64)
+	}
+	return e
+}
+
+/* Back from an export line. A mail that was mid-send when it was
+ * exported goes back in line, as it would have on shutdown */
+func ConvertMailExport(e MailExport) (*Mail, error) {
+	if e.IdempotencyKey == "" {
+		return nil, fmt.Errorf("Exported mail needs its idempotency_key")
+	}
+
+	m, err := ConvertMailRequest(e.MailRequest)
+	if err != nil {
+		return nil, err
+	}
+	/* It was scoped when it was first scheduled */
+	m.Idem = e.IdempotencyKey
+
+	switch e.State {
+	case "":
+		m.State = UNSENT
+	case INPROG:
+		m.State = UNSENT
+		if e.TryCount > 0 {
+			m.State = FAILED
+		}
+	case UNSENT, FAILED, SENT, EXPIRED, PAUSED:
+		m.State = e.State
+	default:
+		return nil, fmt.Errorf("Unknown state %q", e.State)
+	}
+
+	if e.TryCount < 0 {
+		return nil, fmt.Errorf("try_count can't be negative")
+	}
+	m.TryCount = e.TryCount
+	m.ProviderID = sql.NullString{
+		Valid: e.ProviderID != "",
+		String: e.ProviderID,
+	}
 	return m, nil
 }
 
+/* Mail priority classes. Higher goes first; anything
+ * that doesn't say otherwise is PriorityNormal */
+const (
+	PriorityLow Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh Priority = 1
+)
+
+var priorityNames = map[Priority]string{
+	PriorityLow: "low",
+	PriorityNormal: "normal",
+	PriorityHigh: "high",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
 
+func (p Priority) MarshalJSON() ([]byte, error) {
+	name, ok := priorityNames[p]
+	if !ok {
+		return nil, fmt.Errorf("Unknown priority %d", int(p))
+	}
+	return json.Marshal(name)
+}
+
+func (p *Priority) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+
+	if name == "" {
+		*p = PriorityNormal
+		return nil
+	}
+
+	for prio, pname := range priorityNames {
+		if pname == name {
+			*p = prio
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown priority %q, expected low, normal or high", name)
+}
+
+/* Has this mail's deadline for sending passed? */
+func (m *Mail) Expired(when time.Time) bool {
+	return m.ExpiresAt.Valid && m.ExpiresAt.Int64 <= when.UTC().Unix()
+}
+
+/* Whether a request to schedule m is a replay of the stored mail.
+ * Its recipient, job and timing have to match; so does what it says,
+ * unless that's since been edited or purged */
+func (stored *Mail) SameRequest(m *Mail) bool {
+	same := stored.JobKey == m.JobKey &&
+		stored.Sub == m.Sub &&
+		stored.Missive == m.Missive &&
+		stored.ToAddr == m.ToAddr &&
+		stored.ToName == m.ToName &&
+		time.Time(stored.SendAt).Unix() == time.Time(m.SendAt).Unix() &&
+		stored.Domain == m.Domain &&
+		stored.Priority == m.Priority &&
+		stored.ExpiresAt == m.ExpiresAt
+	if !same || stored.Revision > 0 || (stored.HTMLBody == "" && stored.TextBody == "") {
+		return same
+	}
+
+	if stored.FromAddr != m.FromAddr ||
+		stored.FromName != m.FromName ||
+		stored.ReplyTo != m.ReplyTo ||
+		stored.Title != m.Title ||
+		stored.HTMLBody != m.HTMLBody ||
+		stored.TextBody != m.TextBody {
+		return false
+	}
+
+	/* Inline attachments are stored ahead of the refs */
+	hashes := make([]string, 0, len(m.Attachments) + len(m.AttachmentRefs))
+	for _, a := range m.Attachments {
+		hashes = append(hashes, a.Hash())
+	}
+	hashes = append(hashes, m.AttachmentRefs...)
+	if len(hashes) != len(stored.Attachments) {
+		return false
+	}
+	for i, a := range stored.Attachments {
+		if a.Hash() != hashes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* Once saved, a mail keeps the key it was saved under, even
+ * if the fields it was derived from are later edited */
 func (m *Mail) IdemKey() string {
+	if m.Idem != "" {
+		return m.Idem
+	}
+
+	return deriveIdemKey(m.JobKey, m.ToAddr, m.Title)
+}
+
+/* What's kept of the recipient once a mail's contents are purged */
+func RecipientHash(addr string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(addr))))
+	return hex.EncodeToString(h[:])
+}
+
+/* Each field is length prefixed, so that
+ * ("ab", "c@x") and ("a", "bc@x") don't collide */
+func deriveIdemKey(fields ...string) string {
 	h := sha256.New()
-	h.Write([]byte(m.JobKey))
-	h.Write([]byte(m.ToAddr))
-	h.Write([]byte(m.Title))
+	l := make([]byte, 4)
+	for _, f := range fields {
+		binary.LittleEndian.PutUint32(l, uint32(len(f)))
+		h.Write(l)
+		h.Write([]byte(f))
+	}
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -169,8 +588,28 @@ func (t *Timestamp) Scan(src interface{}) error {
 }
 
 func (as *AttachSet) UnmarshalJSON(data []byte) error {
-	var attachs []*Attachment
-	json.Unmarshal(data, &attachs)
+	return as.unmarshalJSON(data, newAttachBudget(maxAttachmentSetTLV))
+}
+
+func (as *AttachSet) unmarshalJSON(data []byte, budget *attachBudget) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("attachments must be a list: %s", err)
+	}
+	if len(entries) > maxAttachments {
+		return fmt.Errorf("Too many attachments: %d, limit %d", len(entries), maxAttachments)
+	}
+
+	attachs := make([]*Attachment, len(entries))
+	for i, entry := range entries {
+		if string(bytes.TrimSpace(entry)) == "null" {
+			return fmt.Errorf("attachment %d is null", i)
+		}
+		attachs[i] = &Attachment{}
+		if err := attachs[i].unmarshalJSON(entry, budget); err != nil {
+			return fmt.Errorf("attachment %d: %s", i, err)
+		}
+	}
 
 	*as = AttachSet(attachs)
 	return nil
@@ -226,20 +665,27 @@ func (as *AttachSet) Scan(src interface{}) error {
 	source = src.([]byte)
 
 	/* Read out the length */
+	budget := newAttachBudget(maxAttachmentSetTLV)
 	var ptr int = 0
 	length := len(source)
 	for ptr < length {
+		if len(set) == maxAttachments {
+			return fmt.Errorf("Too many attachments, limit %d", maxAttachments)
+		}
+		if length - ptr < 4 {
+			return fmt.Errorf("attachment %d: length truncated, %d bytes left at offset %d", len(set), length - ptr, ptr)
+		}
 		size := int(binary.LittleEndian.Uint32(source[ptr:ptr+4]))
 
 		ptr += 4
-		if ptr + size > length {
-			return fmt.Errorf("Invalid length: %d, limit %d", ptr, length)
+		if size > length - ptr {
+			return fmt.Errorf("attachment %d: length %d at offset %d overruns the %d bytes left", len(set), size, ptr - 4, length - ptr)
 		}
 
 		attachment := &Attachment{}
-		err := attachment.Plump(source[ptr:ptr+size])
+		err := attachment.plump(source[ptr:ptr+size], budget)
 		if err != nil {
-			return err
+			return fmt.Errorf("attachment %d: %s", len(set), err)
 		}
 
 		ptr += size
@@ -262,21 +708,101 @@ func (a Attachment) MarshalJSON() ([]byte, error) {
 }
 
 func (a *Attachment) UnmarshalJSON(data []byte) error {
+	return a.unmarshalJSON(data, newAttachBudget(maxAttachmentTLV))
+}
+
+/* Unzipping takes from the budget; an object's content is already
+ * as big as it'll get, so it's counted against it as it is */
+func (a *Attachment) unmarshalJSON(data []byte, budget *attachBudget) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var obj AttachmentObject
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		attach, err := obj.Attachment()
+		if err != nil {
+			return err
+		}
+		if err = budget.take(int64(len(attach.Content))); err != nil {
+			return err
+		}
+		*a = *attach
+		return nil
+	}
+
 	/* We wrap gzipped attachments in base64 encoding */
 	var buf []byte
-	json.Unmarshal(data, &buf)
+	if err := json.Unmarshal(data, &buf); err != nil {
+		return fmt.Errorf("attachment must be base64 or an object: %s", err)
+	}
 
-	return a.Plump(buf)
+	return a.plump(buf, budget)
 }
 
-/* Write out the attachments as gzipped blob data */
-func (a Attachment) Value() (driver.Value, error) {
+/* Check the object over and turn it into an Attachment. Without a
+ * content_type, it's worked out from the filename and content */
+func (obj AttachmentObject) Attachment() (*Attachment, error) {
+	if obj.Filename == "" {
+		return nil, fmt.Errorf("Attachment is missing a filename")
+	}
+	if obj.ContentBase64 == nil {
+		return nil, fmt.Errorf("Attachment %s is missing content_base64", obj.Filename)
+	}
+	content, err := base64.StdEncoding.DecodeString(*obj.ContentBase64)
+	if err != nil {
+		return nil, fmt.Errorf("Attachment %s content_base64: %s", obj.Filename, err)
+	}
+
+	a := &Attachment{
+		Name: obj.Filename,
+		Type: obj.ContentType,
+		Content: content,
+		Disposition: obj.Disposition,
+		ContentID: obj.ContentID,
+	}
+	if a.Type == "" {
+		a.Type = SniffType(a.Name, content)
+	}
+	if a.Disposition == "attachment" {
+		a.Disposition = ""
+	}
+	switch {
+	case a.Disposition != "" && a.Disposition != "inline":
+		return nil, fmt.Errorf("Attachment %s disposition must be attachment or inline, not %s", obj.Filename, obj.Disposition)
+	case a.Disposition == "inline" && a.ContentID == "":
+		return nil, fmt.Errorf("Attachment %s is inline, so needs a content_id", obj.Filename)
+	}
+	return a, nil
+}
+
+func (a Attachment) tlv() []byte {
 	var b []byte
 
-	/* TLV! 1: name, 2: type, 3: content */
+	/* TLV! 1: name, 2: type, 3: content, 4: disposition, 5: content id.
+	 * 4 and 5 are left off when blank, so attachments from before
+	 * they were added still hash the same */
 	b = putString(0x01, b, a.Name)
 	b = putString(0x02, b, a.Type)
 	b = putBytes(0x03, b, a.Content)
+	if a.Disposition != "" {
+		b = putString(0x04, b, a.Disposition)
+	}
+	if a.ContentID != "" {
+		b = putString(0x05, b, a.ContentID)
+	}
+	return b
+}
+
+/* Attachments are stored by the hash of their (unzipped) TLV, so the
+ * same file with the same name and type is only ever stored once */
+func (a Attachment) Hash() string {
+	h := sha256.Sum256(a.tlv())
+	return hex.EncodeToString(h[:])
+}
+
+/* Write out the attachments as gzipped blob data */
+func (a Attachment) Value() (driver.Value, error) {
+	b := a.tlv()
 
 	zipped := make([]byte, 0, len(b))
 	buf := bytes.NewBuffer(zipped)
@@ -307,47 +833,111 @@ func (a *Attachment) Scan(src interface{}) error {
 	return nil
 }
 
-/* Now we go backward! */
+/* An attachment as it goes in a MailRequest's attachments: its
+ * gzipped TLV, base64'd */
+func (a Attachment) Encode() (string, error) {
+	value, err := a.Value()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(value.([]byte)), nil
+}
+
+/* And back from an attachments entry */
+func DecodeAttachment(entry string) (*Attachment, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry))
+	if err != nil {
+		return nil, fmt.Errorf("attachment isn't base64: %s", err)
+	}
+
+	a := &Attachment{}
+	if err = a.Plump(buf); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+/* A file's content type, by its extension if that says more than
+ * "some bytes", otherwise by sniffing its content */
+func SniffType(name string, content []byte) string {
+	typ := mime.TypeByExtension(filepath.Ext(name))
+	if typ != "" && typ != "application/octet-stream" {
+		return typ
+	}
+	return http.DetectContentType(content)
+}
+
+/* Now we go backward! Leaves a be if buf isn't a whole, well-formed
+ * attachment */
 func (a *Attachment) Plump(buf []byte) error {
-	/* First things first, we unzip the src */
-	reader, _ := gzip.NewReader(bytes.NewReader(buf))
-	src, err := ioutil.ReadAll(reader)
+	return a.plump(buf, newAttachBudget(maxAttachmentTLV))
+}
+
+/* Plump, unzipping no more than what's left of budget (nor more than
+ * any one attachment can be), and taking what it used from it */
+func (a *Attachment) plump(buf []byte, budget *attachBudget) error {
+	/* First things first, we unzip the src, minding it isn't a zip bomb */
+	reader, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("Attachment isn't gzipped: %s", err)
+	}
+	defer reader.Close()
+
+	limit := min(budget.left, maxAttachmentTLV)
+	src, err := ioutil.ReadAll(io.LimitReader(reader, limit + 1))
 	if err != nil {
-		reader.Close()
+		return fmt.Errorf("Attachment gzip is corrupt: %s", err)
+	}
+	if len(src) > maxAttachmentTLV {
+		return fmt.Errorf("Attachment unzips to more than %d bytes", maxAttachmentTLV)
+	}
+	if err = budget.take(int64(len(src))); err != nil {
 		return err
 	}
-	reader.Close()
 
 	/* Then we parse the data */
+	var attach Attachment
+	var seen [6]bool
 	length := len(src)
 	ptr := 0
 
 	for ptr < length {
 		/* Read off type + len */
-		typ_val := src[ptr:ptr+1]
-		typ := int(uint8(typ_val[0]))
+		if length - ptr < 5 {
+			return fmt.Errorf("Attachment truncated: %d bytes left at offset %d, short of a type and length", length - ptr, ptr)
+		}
+		typ := int(src[ptr])
 
 		ptr += 1
 		typLen := int(binary.LittleEndian.Uint32(src[ptr:ptr+4]))
 
 		ptr += 4
-		if ptr + typLen > length {
-			return fmt.Errorf("Attachment parsing overflowed for type %d", typ)
+		if typLen > length - ptr {
+			return fmt.Errorf("Attachment parsing overflowed for type %d: length %d at offset %d, %d bytes left", typ, typLen, ptr - 4, length - ptr)
+		}
+		if typ < len(seen) && seen[typ] {
+			return fmt.Errorf("Attachment has type %d twice", typ)
 		}
 
 		switch (typ) {
 		case 0x01:
-			a.Name = string(src[ptr:ptr+typLen])
+			attach.Name = string(src[ptr:ptr+typLen])
 		case 0x02:
-			a.Type = string(src[ptr:ptr+typLen])
+			attach.Type = string(src[ptr:ptr+typLen])
 		case 0x03:
-			a.Content = src[ptr:ptr+typLen]
+			attach.Content = src[ptr:ptr+typLen]
+		case 0x04:
+			attach.Disposition = string(src[ptr:ptr+typLen])
+		case 0x05:
+			attach.ContentID = string(src[ptr:ptr+typLen])
 		default:
 			return fmt.Errorf("attachment type not known: %d", typ)
 		}
 
+		seen[typ] = true
 		ptr += typLen
 	}
 
+	*a = attach
 	return nil
 }
@@ -1,11 +1,17 @@
 package mail
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"strings"
 	tt "testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestAttachment(t *tt.T) {
@@ -90,6 +96,308 @@ func TestAttachments(t *tt.T) {
 	}
 }
 
+func TestAttachmentEncoding(t *tt.T) {
+	a := Attachment{
+		Content: []byte("new content to write in"),
+		Type: "text/plain",
+		Name: "content.txt",
+	}
+
+	entry, err := a.Encode()
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	b, err := DecodeAttachment(entry)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	} else if !cmp.Equal(a, *b) {
+		t.Errorf("was expecting %+v, got %+v", a, *b)
+	}
+
+	/* The one in the README */
+	b, err = DecodeAttachment("H4sIAAAAAAAA/2LkZmBgSM7PK0nNK9ErqShh4mJgYChJrSjRL8hJzMxjFmdgYMhLLVeAKlEoyVcoL8osSVXIzAMEAAD//2GY2D47AAAA")
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	} else if !cmp.Equal(a, *b) {
+		t.Errorf("was expecting %+v, got %+v", a, *b)
+	}
+
+	if _, err = DecodeAttachment("not base64!"); err == nil {
+		t.Errorf("was expecting err for an entry that isn't base64")
+	}
+
+	types := []struct {
+		name string
+		content string
+		typ string
+	}{
+		{ "notes.txt", "hi", "text/plain; charset=utf-8" },
+		{ "invoice.pdf", "anything", "application/pdf" },
+		{ "invoice", "%PDF-1.4", "application/pdf" },
+		{ "photo", "\x89PNG\r\n\x1a\n", "image/png" },
+		{ "blob", "\x00\x01\x02", "application/octet-stream" },
+	}
+	for _, typ := range types {
+		if got := SniffType(typ.name, []byte(typ.content)); got != typ.typ {
+			t.Errorf("expecting %s for %s, got %s", typ.typ, typ.name, got)
+		}
+	}
+}
+
+func TestAttachmentObject(t *tt.T) {
+	var as AttachSet
+	data := `[
+		"H4sIAAAAAAAA/2LkZmBgSM7PK0nNK9ErqShh4mJgYChJrSjRL8hJzMxjFmdgYMhLLVeAKlEoyVcoL8osSVXIzAMEAAD//2GY2D47AAAA",
+		{"filename": "invoice.pdf", "content_base64": "JVBERi0xLjQ="},
+		{"filename": "logo", "content_type": "image/png", "content_base64": "iVBORw0KGgo=", "disposition": "inline", "content_id": "logo@base58"},
+		{"filename": "notes.txt", "content_base64": "", "disposition": "attachment"}
+	]`
+	if err := json.Unmarshal([]byte(data), &as); err != nil {
+		t.Fatalf("was not expecting err %s", err)
+	}
+
+	exp := AttachSet{
+		{ Name: "content.txt", Type: "text/plain", Content: []byte("new content to write in") },
+		{ Name: "invoice.pdf", Type: "application/pdf", Content: []byte("%PDF-1.4") },
+		{ Name: "logo", Type: "image/png", Content: []byte("\x89PNG\r\n\x1a\n"), Disposition: "inline", ContentID: "logo@base58" },
+		{ Name: "notes.txt", Type: "text/plain; charset=utf-8", Content: []byte{} },
+	}
+	if !cmp.Equal(exp, as) {
+		t.Errorf("was expecting %+v, got %+v", exp, as)
+	}
+
+	/* Inline attachments keep their disposition and content id through
+	 * the TLV; plain ones encode the same as they always have */
+	v, err := as.Value()
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	var back AttachSet
+	if err = (&back).Scan(v); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if !cmp.Equal(as[2], back[2]) {
+		t.Errorf("was expecting %+v, got %+v", as[2], back[2])
+	}
+	plain := "\x01\x0b\x00\x00\x00content.txt\x02\x0a\x00\x00\x00text/plain\x03\x17\x00\x00\x00new content to write in"
+	if tlv := string(as[0].tlv()); tlv != plain {
+		t.Errorf("expecting a plain attachment to encode as before, got %q", tlv)
+	}
+
+	bad := []string{
+		`{"content_base64": "aGk="}`,
+		`{"filename": "a.txt"}`,
+		`{"filename": "a.txt", "content_base64": "not base64!"}`,
+		`{"filename": "a.txt", "content_base64": "aGk=", "disposition": "sideways"}`,
+		`{"filename": "a.png", "content_base64": "aGk=", "disposition": "inline"}`,
+	}
+	for _, b := range bad {
+		var a Attachment
+		if err := json.Unmarshal([]byte(b), &a); err == nil {
+			t.Errorf("was expecting err for %s", b)
+		}
+	}
+}
+
+/* Gzip some bytes, as if they were an attachment's TLV */
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+/* A length-prefixed AttachSet blob of the given entries */
+func attachSetBlob(entries ...[]byte) []byte {
+	var b []byte
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(e)))
+		b = append(b, e...)
+	}
+	return b
+}
+
+func TestAttachmentDecoding(t *tt.T) {
+	good, _ := Attachment{ Name: "a.txt", Type: "text/plain", Content: []byte("hi") }.Value()
+	tlv := Attachment{ Name: "a.txt", Type: "text/plain", Content: []byte("hi") }.tlv()
+
+	/* Every one of these used to panic or get through */
+	plumps := map[string][]byte{
+		"not gzip": []byte("hello"),
+		"empty": []byte{},
+		"corrupt gzip": good.([]byte)[:len(good.([]byte)) - 4],
+		"short header": gzipped(tlv[:len(tlv) - 2 - 3]),
+		"overflow": gzipped(append([]byte{ 0x01, 0xff, 0xff, 0xff, 0xff }, "a.txt"...)),
+		"twice": gzipped(append(append([]byte{}, tlv...), tlv[:10]...)),
+		"unknown type": gzipped([]byte{ 0x09, 0, 0, 0, 0 }),
+		"zip bomb": gzipped(make([]byte, maxAttachmentTLV + 1)),
+	}
+	for name, buf := range plumps {
+		a := Attachment{ Name: "untouched" }
+		if err := a.Plump(buf); err == nil {
+			t.Errorf("%s: was expecting err", name)
+		}
+		if a.Name != "untouched" {
+			t.Errorf("%s: expecting a bad attachment to leave it be, got %+v", name, a)
+		}
+	}
+
+	tooMany := make([][]byte, maxAttachments + 1)
+	for i := range tooMany {
+		tooMany[i] = good.([]byte)
+	}
+	scans := map[string][]byte{
+		"truncated length": append(attachSetBlob(good.([]byte)), 0x05, 0x00),
+		"overrun": attachSetBlob(good.([]byte))[:10],
+		"bad entry": attachSetBlob(good.([]byte), []byte("nope")),
+		"too many": attachSetBlob(tooMany...),
+	}
+	for name, blob := range scans {
+		var as AttachSet
+		if err := as.Scan(blob); err == nil {
+			t.Errorf("%s: was expecting err", name)
+		}
+	}
+
+	entry := `"` + base64.StdEncoding.EncodeToString(good.([]byte)) + `"`
+	jsons := map[string]string{
+		"not a list": `{"filename": "a.txt"}`,
+		"null entry": `[` + entry + `, null]`,
+		"number": `[42]`,
+		"bad base64": `["!!!"]`,
+		"too many": `[` + strings.Repeat(entry + `,`, maxAttachments) + entry + `]`,
+	}
+	for name, data := range jsons {
+		var as AttachSet
+		if err := json.Unmarshal([]byte(data), &as); err == nil {
+			t.Errorf("%s: was expecting err", name)
+		}
+	}
+
+	/* Which attachment was bad is in the error */
+	var as AttachSet
+	err := json.Unmarshal([]byte(`[` + entry + `, "aGk="]`), &as)
+	if err == nil || !strings.Contains(err.Error(), "attachment 1") {
+		t.Errorf("expecting an error about attachment 1, got %v", err)
+	}
+}
+
+func TestAttachmentSetBudget(t *tt.T) {
+	p := &AttachmentPolicy{ MaxMessageBytes: 1 << 20 }
+
+	/* Each of these is fine on its own, but not all together */
+	big, _ := Attachment{ Name: "a.bin", Type: "application/octet-stream", Content: make([]byte, 400 << 10) }.Value()
+	var a Attachment
+	if err := a.Plump(big.([]byte)); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+
+	entry := `"` + base64.StdEncoding.EncodeToString(big.([]byte)) + `"`
+	request := func(entries ...string) []byte {
+		return []byte(`{"job_key": "k", "attachments": [` + strings.Join(entries, ",") + `]}`)
+	}
+	var job MailRequest
+	if err := DecodeMailRequest(request(entry, entry), &job, p); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if len(job.Attachments) != 2 {
+		t.Errorf("expecting %d attachments, got %d", 2, len(job.Attachments))
+	}
+	if err := DecodeMailRequest(request(entry, entry, entry), &job, p); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	/* Objects aren't zipped, but count all the same */
+	object := `{"filename": "a.bin", "content_base64": "` + base64.StdEncoding.EncodeToString(make([]byte, 400 << 10)) + `"}`
+	if err := DecodeMailRequest(request(entry, object), &job, p); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if err := DecodeMailRequest(request(entry, entry, object), &job, p); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	/* Imports and what's stored aren't held to the policy */
+	var e MailExport
+	if err := json.Unmarshal(request(entry, entry, entry), &e); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	var as AttachSet
+	if err := as.Scan(attachSetBlob(big.([]byte), big.([]byte), big.([]byte))); err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+
+	/* ...only to what any mail can unzip to */
+	if err := as.unmarshalJSON([]byte(`[` + entry + `,` + entry + `]`), newAttachBudget(600 << 10)); err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+}
+
+func FuzzPlump(f *tt.F) {
+	for _, a := range []Attachment{
+		{ Name: "a.txt", Type: "text/plain", Content: []byte("hi") },
+		{ Name: "logo", Type: "image/png", Content: []byte{ 0x89 }, Disposition: "inline", ContentID: "logo" },
+		{},
+	} {
+		v, _ := a.Value()
+		f.Add(v.([]byte))
+		f.Add(a.tlv())
+	}
+	f.Add([]byte{ 0x1f, 0x8b })
+
+	f.Fuzz(func(t *tt.T, buf []byte) {
+		var a Attachment
+		if err := a.Plump(buf); err != nil {
+			return
+		}
+
+		/* Whatever decodes has to survive the trip back */
+		v, err := a.Value()
+		if err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		var b Attachment
+		if err = b.Plump(v.([]byte)); err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		if !cmp.Equal(a, b, cmpopts.EquateEmpty()) {
+			t.Errorf("was expecting %+v, got %+v", a, b)
+		}
+	})
+}
+
+func FuzzAttachSetScan(f *tt.F) {
+	good, _ := Attachment{ Name: "a.txt", Type: "text/plain", Content: []byte("hi") }.Value()
+	f.Add(attachSetBlob(good.([]byte)))
+	f.Add(attachSetBlob(good.([]byte), good.([]byte)))
+	f.Add([]byte{ 0xff, 0xff, 0xff, 0xff })
+	f.Add([]byte{ 0x01 })
+
+	f.Fuzz(func(t *tt.T, blob []byte) {
+		var as AttachSet
+		if err := as.Scan(blob); err != nil {
+			return
+		}
+		if len(as) > maxAttachments {
+			t.Errorf("expecting at most %d attachments, got %d", maxAttachments, len(as))
+		}
+
+		v, err := as.Value()
+		if err != nil {
+			t.Fatalf("was not expecting err %s", err)
+		}
+		var back AttachSet
+		if v != nil {
+			if err = back.Scan(v); err != nil {
+				t.Fatalf("was not expecting err %s", err)
+			}
+		}
+		if !cmp.Equal(as, back, cmpopts.EquateEmpty()) {
+			t.Errorf("was expecting %+v, got %+v", as, back)
+		}
+	})
+}
+
 func TestTimestamp(t *tt.T) {
 
 	var a Timestamp
@@ -111,3 +419,101 @@ func TestTimestamp(t *tt.T) {
 		t.Errorf("expecting %d, got %d", stamp, res.UTC().Unix())
 	}
 }
+
+func TestPriority(t *tt.T) {
+	var req MailRequest
+	err := json.Unmarshal([]byte(`{"job_key": "k", "priority": "high"}`), &req)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if req.Priority != PriorityHigh {
+		t.Errorf("expecting %s, got %s", PriorityHigh, req.Priority)
+	}
+
+	/* Left off means normal */
+	req = MailRequest{}
+	json.Unmarshal([]byte(`{"job_key": "k"}`), &req)
+	if req.Priority != PriorityNormal {
+		t.Errorf("expecting %s, got %s", PriorityNormal, req.Priority)
+	}
+
+	err = json.Unmarshal([]byte(`{"priority": "urgent"}`), &req)
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	data, err := json.Marshal(PriorityLow)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if string(data) != `"low"` {
+		t.Errorf("expecting %s, got %s", `"low"`, data)
+	}
+}
+
+func TestConvertExpiry(t *tt.T) {
+	req := MailRequest{
+		JobKey: "k",
+		TextBody: "hi",
+		SendAt: 1680358878,
+		ExpiresIn: 3600,
+	}
+
+	m, err := ConvertMailRequest(req)
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if !m.ExpiresAt.Valid || m.ExpiresAt.Int64 != 1680358878 + 3600 {
+		t.Errorf("expecting expiry at %d, got %+v", 1680358878 + 3600, m.ExpiresAt)
+	}
+	if !m.Expired(time.Unix(1680358878 + 3600, 0)) {
+		t.Errorf("expecting mail to have expired")
+	}
+
+	/* Deadline before it's due */
+	req.ExpiresIn = 0
+	req.ExpiresAt = 1680358878 - 1
+	_, err = ConvertMailRequest(req)
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+
+	/* Not both */
+	req.ExpiresAt = 1680358878 + 1
+	req.ExpiresIn = 1
+	_, err = ConvertMailRequest(req)
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+}
+
+func TestIdemKey(t *tt.T) {
+	a := &Mail{JobKey: "ab", ToAddr: "c@x", Title: "hi"}
+	b := &Mail{JobKey: "a", ToAddr: "bc@x", Title: "hi"}
+	if a.IdemKey() == b.IdemKey() {
+		t.Errorf("wasn't expecting %+v and %+v to share a key", a, b)
+	}
+
+	/* Client keys win, scoped to their job */
+	m, err := ConvertMailRequest(MailRequest{
+		IdempotencyKey: "series-1:lesson-2",
+		JobKey: "ab",
+		ToAddr: "c@x",
+		Title: "hi",
+		TextBody: "hi",
+	})
+	if err != nil {
+		t.Errorf("was not expecting err %s", err)
+	}
+	if exp := deriveIdemKey("ab", "series-1:lesson-2"); m.IdemKey() != exp {
+		t.Errorf("expecting %s, got %s", exp, m.IdemKey())
+	}
+
+	_, err = ConvertMailRequest(MailRequest{
+		IdempotencyKey: "no/slashes",
+		TextBody: "hi",
+	})
+	if err == nil {
+		t.Errorf("was expecting err, didn't get one")
+	}
+}
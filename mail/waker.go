@@ -0,0 +1,31 @@
+package mail
+
+/* Waker lets the API nudge the mail worker out of its sleep when new
+ * mail has been scheduled, rather than waiting out the poll timer.
+ * Wakes coalesce: any number of Wake calls while the worker is busy
+ * results in a single wake up. */
+type Waker struct {
+	c chan struct{}
+}
+
+func NewWaker() *Waker {
+	return &Waker{
+		c: make(chan struct{}, 1),
+	}
+}
+
+func (wk *Waker) Wake() {
+	if wk == nil {
+		return
+	}
+
+	select {
+	case wk.c <- struct{}{}:
+	default:
+		/* Already a wake pending */
+	}
+}
+
+func (wk *Waker) C() <-chan struct{} {
+	return wk.c
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/base58btc/mailer/mail"
@@ -16,11 +21,32 @@ type env struct {
 	SendGrid string
 	SendTimer int
 	DbName string
+	DevStore bool
 	IsProd bool
 	Port string
 	MailGunKey string
 	MailDomains string
 	Secret string
+	/* Bearer token for /metrics; blank leaves it open */
+	MetricsToken string
+	/* Blank password leaves the dashboard off */
+	DashboardUser string
+	DashboardPassword string
+	LogLevel slog.Level
+	/* Otherwise logfmt-ish text */
+	LogJSON bool
+	WorkerID string
+	LeaseTime time.Duration
+	/* How long the worker can go quiet before it's not ready */
+	StallAfter time.Duration
+	/* Zero keeps sent mail forever */
+	RetainBodyDays int
+	RetainRowDays int
+	/* Blank leaves mail contents unencrypted */
+	EncryptionKeys string
+	EncryptionKeyID string
+	/* What attachments mail can have */
+	AttachmentPolicy *mail.AttachmentPolicy
 }
 
 func setupEnv() (*env, error) {
@@ -28,7 +54,7 @@ func setupEnv() (*env, error) {
 	var err error
 
 	if secrets := os.Getenv("SECRETS_FILE"); secrets != "" {
-		fmt.Println("using secrets", secrets)
+		slog.Info("Using secrets", "file", secrets)
 		err = godotenv.Load(secrets)
 	} else {
 		err = godotenv.Load()
@@ -46,55 +72,425 @@ func setupEnv() (*env, error) {
 	e.MailDomains = os.Getenv("MAIL_DOMAINS")
 	e.SendTimer = int(val)
 	e.DbName = os.Getenv("DB_NAME")
+	e.DevStore = os.Getenv("DATASTORE") == "memory"
 	e.IsProd = os.Getenv("PROD") == "1"
 	e.Port = os.Getenv("PORT")
 	e.Secret = os.Getenv("HMAC_SECRET")
+	e.MetricsToken = os.Getenv("METRICS_TOKEN")
+	e.DashboardUser = os.Getenv("DASHBOARD_USER")
+	if e.DashboardUser == "" {
+		e.DashboardUser = "admin"
+	}
+	e.DashboardPassword = os.Getenv("DASHBOARD_PASSWORD")
+	e.LogJSON = os.Getenv("LOG_FORMAT") == "json"
+	if e.LogLevel, err = mail.ParseLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %s", err)
+	}
+	e.EncryptionKeys = os.Getenv("ENCRYPTION_KEYS")
+	e.EncryptionKeyID = os.Getenv("ENCRYPTION_KEY_ID")
+
+	e.WorkerID = os.Getenv("WORKER_ID")
+	if e.WorkerID == "" {
+		host, _ := os.Hostname()
+		e.WorkerID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	for name, days := range map[string]*int{
+		"RETAIN_BODY_DAYS": &e.RetainBodyDays,
+		"RETAIN_ROW_DAYS": &e.RetainRowDays,
+	} {
+		if v := os.Getenv(name); v != "" {
+			val, err = strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			if val < 0 {
+				return nil, fmt.Errorf("%s can't be negative", name)
+			}
+			*days = int(val)
+		}
+	}
+
+	e.LeaseTime = 5 * time.Minute
+	if lease := os.Getenv("MAIL_LEASE_SECS"); lease != "" {
+		val, err = strconv.ParseInt(lease, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		e.LeaseTime = time.Duration(val) * time.Second
+	}
+
+	/* A sleep between polls, plus a slow provider call or two */
+	e.StallAfter = 2 * time.Duration(e.SendTimer) * time.Second + 2 * time.Minute
+	if stall := os.Getenv("WORKER_STALL_SECS"); stall != "" {
+		val, err = strconv.ParseInt(stall, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		e.StallAfter = time.Duration(val) * time.Second
+	}
+
+	e.AttachmentPolicy = mail.DefaultAttachmentPolicy()
+	for name, size := range map[string]*int64{
+		"ATTACH_MAX_BYTES": &e.AttachmentPolicy.MaxAttachmentBytes,
+		"MAIL_MAX_BYTES": &e.AttachmentPolicy.MaxMessageBytes,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if *size, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			if *size < 0 {
+				return nil, fmt.Errorf("%s can't be negative", name)
+			}
+		}
+	}
+	if e.AttachmentPolicy.Allow, err = mail.ParseTypeList(os.Getenv("ATTACH_ALLOW_TYPES")); err != nil {
+		return nil, fmt.Errorf("ATTACH_ALLOW_TYPES: %s", err)
+	}
+	if e.AttachmentPolicy.Deny, err = mail.ParseTypeList(os.Getenv("ATTACH_DENY_TYPES")); err != nil {
+		return nil, fmt.Errorf("ATTACH_DENY_TYPES: %s", err)
+	}
+	switch mismatch := os.Getenv("ATTACH_TYPE_MISMATCH"); mismatch {
+	case "":
+	case mail.MismatchOverride, mail.MismatchReject:
+		e.AttachmentPolicy.Mismatch = mismatch
+	default:
+		return nil, fmt.Errorf("ATTACH_TYPE_MISMATCH must be %s or %s", mail.MismatchOverride, mail.MismatchReject)
+	}
 	return &e, nil
 }
 
-/* For now, we do it simply with a single worker bot */
-func mailWorker(e *env, ds *mail.Datastore, mailers map[string]*mail.Mailer) {
+/* Run the mail worker until ctx is cancelled. If it fails (or panics)
+ * it's restarted, backing off up to a minute between tries while it
+ * keeps failing. */
+func superviseWorker(ctx context.Context, e *env, ds mail.Datastore, mailers map[string]*mail.Mailer, waker *mail.Waker, health *mail.WorkerHealth) {
+	backoff := time.Second
+	unrecorded := make(unrecordedSends)
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := runWorker(ctx, e, ds, mailers, waker, health, unrecorded)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
 
-	defaultDomain := e.DefaultDomain()
-	dd, ok := mailers[defaultDomain]
-	if !ok {
-		fmt.Printf("Unable to get default domain %s", defaultDomain)
-		os.Exit(1)
+		/* A good run earns a fresh start on the backoff */
+		if time.Since(started) > 10 * time.Minute {
+			backoff = time.Second
+		}
+		health.Failed(err)
+		slog.Error("Mail worker failed, restarting", "err", err, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
 	}
+}
 
-	for {
-		mails, err := ds.GetToSendBatch(time.Now(), 1000)
+func runWorker(ctx context.Context, e *env, ds mail.Datastore, mailers map[string]*mail.Mailer, waker *mail.Waker, health *mail.WorkerHealth, unrecorded unrecordedSends) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("worker panicked: %v", p)
+		}
+	}()
+	return mailWorker(ctx, e, ds, mailers, waker, health, unrecorded)
+}
+
+/* Mail the provider took that we couldn't record as sent, by idem key,
+ * with the provider's id for it. They stay claimed, as handing them
+ * back would send them again, and we keep trying to record them */
+type unrecordedSends map[string]string
+
+func (u unrecordedSends) keys() []string {
+	keys := make([]string, 0, len(u))
+	for key := range u {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+/* Try again to record what was sent */
+func (u unrecordedSends) record(ds mail.Datastore) {
+	for key, id := range u {
+		if err := ds.MarkSent(key, id); err != nil {
+			slog.Error("Still unable to record a sent mail", "idem_key", key, "provider_id", id, "err", err)
+			continue
+		}
+		slog.Info("Recorded mail sent earlier", "idem_key", key, "provider_id", id)
+		delete(u, key)
+	}
+}
+
+/* Retry a datastore write that has to happen, such as recording a
+ * mail as sent, through a moment of SQLITE_BUSY or a flaky disk */
+func mustRecord(ctx context.Context, what func() error) (err error) {
+	wait := 500 * time.Millisecond
+	for try := 1; ; try++ {
+		if err = what(); err == nil || try == 5 {
+			return err
+		}
+		slog.Warn("Unable to update mail, retrying", "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+/* Hand one mail to its provider. A panic along the way is a failed
+ * send, so the mail is rescheduled rather than left claimed */
+func sendOne(ms *mail.Mailer, m *mail.Mail) (id string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("send panicked: %v", p)
+		}
+	}()
+	return ms.SendMail(m)
+}
+
+/* For now, we do it simply with a single worker bot. When ctx is
+ * cancelled we stop claiming, finish the send in flight and hand back
+ * whatever is left of the batch. Errors the worker can't get past are
+ * returned, for superviseWorker to restart it. */
+func mailWorker(ctx context.Context, e *env, ds mail.Datastore, mailers map[string]*mail.Mailer, waker *mail.Waker, health *mail.WorkerHealth, unrecorded unrecordedSends) error {
+
+	defaultDomain := e.DefaultDomain()
+	dd := mailers[defaultDomain]
+
+	defer func() {
+		released, err := ds.ReleaseClaims(e.WorkerID, unrecorded.keys()...)
 		if err != nil {
-			fmt.Printf("Unable to fetch batch %s", err)
-			os.Exit(1)
+			slog.Error("Unable to release claims", "worker", e.WorkerID, "err", err)
+			return
+		}
+		slog.Info("Worker stopped", "worker", e.WorkerID, "released", released)
+	}()
+
+	for ctx.Err() == nil {
+		health.Beat()
+		unrecorded.record(ds)
+		if paused, err := ds.IsPaused(); err != nil || paused {
+			if err != nil {
+				slog.Error("Unable to check kill switch", "err", err)
+			} else {
+				slog.Info("Sending is paused", "sleep", time.Second * time.Duration(e.SendTimer))
+			}
+			select {
+			case <-ctx.Done():
+			case <-waker.C():
+			case <-time.After(time.Second * time.Duration(e.SendTimer)):
+			}
+			continue
+		}
+
+		expired, err := ds.ExpireStale(time.Now())
+		if err != nil {
+			slog.Error("Unable to expire stale mails", "err", err)
+		} else if expired > 0 {
+			slog.Info("Expired mails past their deadline", "count", expired)
+			mail.RecordExpired(expired)
 		}
 
-		fmt.Printf("Processing batch of %d mails\n", len(mails))
+		leaseEnd := time.Now().Add(e.LeaseTime)
+		mails, err := ds.GetToSendBatch(time.Now(), 1000, e.WorkerID, e.LeaseTime)
+		if err != nil {
+			return fmt.Errorf("Unable to fetch batch: %w", err)
+		}
+
+		slog.Debug("Processing batch", "count", len(mails))
+		/* Set when a provider's breaker is open, so we don't spin */
+		var holdUntil time.Time
+
 		/* Send off mails to be sent! */
 		for _, m := range mails {
-			ms, ok := mailers[m.Domain]
+			if ctx.Err() != nil {
+				return nil
+			}
+			health.Beat()
+
+			/* Kill switch flipped mid-batch, hand back the rest */
+			if paused, _ := ds.IsPaused(); paused {
+				released, _ := ds.ReleaseClaims(e.WorkerID, unrecorded.keys()...)
+				slog.Info("Sending paused mid-batch", "released", released)
+				break
+			}
+
+			/* Keep our claim alive on long batches */
+			if time.Until(leaseEnd) < e.LeaseTime / 2 {
+				leaseEnd = time.Now().Add(e.LeaseTime)
+				if err := ds.ExtendLease(e.WorkerID, leaseEnd); err != nil {
+					slog.Error("Unable to extend lease", "worker", e.WorkerID, "err", err)
+				}
+			}
+
+			log := slog.With(mail.MailAttrs(m)...)
+			idemKey := m.IdemKey()
+
+			/* Deadline may have passed while we worked the batch */
+			if m.Expired(time.Now()) {
+				log.Info("Mail expired, not sending")
+				if err := mustRecord(ctx, func() error { return ds.MarkExpired(idemKey) }); err != nil {
+					return fmt.Errorf("Unable to mark %s expired: %w", idemKey, err)
+				}
+				mail.RecordExpired(1)
+				continue
+			}
+
+			/* Metrics go by the domain it's actually sent from, so
+			 * there's only ever as many as we have mailers */
+			domain := m.Domain
+			ms, ok := mailers[domain]
 			if !ok {
-				fmt.Printf("unable to find mailer for domain %s, using default %s", m.Domain, defaultDomain)
-				ms = dd
+				log.Warn("No mailer for domain, using the default", "default", defaultDomain)
+				domain, ms = defaultDomain, dd
+			}
+
+			/* Provider's down, hand back the rest until it's worth trying again */
+			breaker := health.Breaker(ms.Provider())
+			if !breaker.Allow(time.Now()) {
+				released, _ := ds.ReleaseClaims(e.WorkerID, unrecorded.keys()...)
+				holdUntil = breaker.RetryAt()
+				log.Warn("Provider circuit open, holding off", "provider", ms.Provider(), "until", holdUntil, "released", released)
+				break
 			}
 
-			id, err := ms.SendMail(m)
+			start := time.Now()
+			id, err := sendOne(ms, m)
+			mail.RecordSend(ms.Provider(), domain, time.Since(start), err)
+			/* A rejected mail is the mail's problem, not the provider's */
+			breaker.Record(err != nil && mail.ErrorClass(err) != "rejected", time.Now())
+			log = log.With("attempt", m.TryCount + 1, "provider", ms.Provider())
 			if err != nil {
-				fmt.Printf("Mail job %s failed (x%d)! %s\n", m.IdemKey(), m.TryCount + 1, err.Error())
+				log.Warn("Send failed", "error_class", mail.ErrorClass(err), "err", mail.RedactError(err))
 				addlTime := time.Duration(m.TryCount * 100)
 				retryAt := time.Now().Add(addlTime * time.Second)
-				ds.RescheduleFailed(m.IdemKey(), m.TryCount + 1, retryAt.UTC().Unix())
+				if m.Expired(retryAt) {
+					log.Info("Retry would be past the deadline, expiring")
+					if err := mustRecord(ctx, func() error { return ds.MarkExpired(idemKey) }); err != nil {
+						return fmt.Errorf("Unable to mark %s expired: %w", idemKey, err)
+					}
+					mail.RecordExpired(1)
+					continue
+				}
+				if err := mustRecord(ctx, func() error {
+					return ds.RescheduleFailed(idemKey, m.TryCount + 1, retryAt.UTC().Unix(), err.Error())
+				}); err != nil {
+					return fmt.Errorf("Unable to reschedule %s: %w", idemKey, err)
+				}
+				mail.RecordRetry(domain)
 			} else {
-				fmt.Println("sent id:", id)
-				ds.MarkSent(m.IdemKey())
+				log.Info("Sent", "provider_id", id)
+				if err := mustRecord(ctx, func() error { return ds.MarkSent(idemKey, id) }); err != nil {
+					/* Keep our claim on it rather than hand it back, and
+					 * try recording it again when the worker restarts. If
+					 * we stop before we manage to, its lease will lapse and
+					 * it'll go out again, so make some noise about it */
+					unrecorded[idemKey] = id
+					log.Error("Sent, but unable to record it; it may be sent twice", "provider_id", id, "err", err)
+					return fmt.Errorf("Unable to mark %s sent: %w", idemKey, err)
+				}
+			}
+		}
+
+		sleep := nextWake(ds, time.Second * time.Duration(e.SendTimer))
+		if wait := time.Until(holdUntil); wait > sleep {
+			sleep = wait
+		}
+		slog.Debug("Batch done", "count", len(mails), "sleep", sleep)
+		select {
+		case <-ctx.Done():
+		case <-waker.C():
+		case <-time.After(sleep):
+		}
+	}
+	return nil
+}
+
+/* Housekeeping that doesn't need to happen every batch */
+func janitor(ctx context.Context, e *env, ds mail.Datastore) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	daysAgo := func(days int) time.Time {
+		if days == 0 {
+			return time.Time{}
+		}
+		return time.Now().AddDate(0, 0, -days)
+	}
+
+	for {
+		stripped, deleted, err := ds.PurgeFinished(daysAgo(e.RetainBodyDays), daysAgo(e.RetainRowDays))
+		if err != nil {
+			slog.Error("Unable to purge finished mail", "err", err)
+		} else if stripped > 0 || deleted > 0 {
+			slog.Info("Purged finished mail", "stripped", stripped, "deleted", deleted)
+		}
+
+		/* Uploads get a day to be referenced before they're fair game */
+		collected, err := ds.CollectAttachments(24 * time.Hour)
+		if err != nil {
+			slog.Error("Unable to collect attachments", "err", err)
+		} else if collected > 0 {
+			slog.Info("Collected unreferenced attachments", "count", collected)
+		}
+
+		/* Bring anything under an old key (or none) onto the current one */
+		for ctx.Err() == nil {
+			count, err := ds.Reencrypt(500)
+			if err != nil {
+				slog.Error("Unable to re-encrypt mail", "err", err)
+				break
+			}
+			if count == 0 {
+				break
+			}
+			slog.Info("Re-encrypted mails and attachments", "count", count)
+		}
+
+		/* Only worth it if retention's on and there was something
+		 * to give back */
+		retaining := e.RetainBodyDays > 0 || e.RetainRowDays > 0
+		if retaining && stripped + deleted + collected > 0 {
+			if err = ds.Vacuum(); err != nil {
+				slog.Error("Unable to vacuum database", "err", err)
 			}
 		}
 
-		fmt.Printf("Batch of %d sent, sleeping %ds\n", len(mails), e.SendTimer)
-		time.Sleep(time.Second * time.Duration(e.SendTimer))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
+/* Sleep until the earliest pending mail is due, but no longer than max */
+func nextWake(ds mail.Datastore, max time.Duration) time.Duration {
+	next, ok, err := ds.NextSendAt()
+	if err != nil {
+		slog.Error("Unable to find next send time", "err", err)
+		return max
+	}
+	if !ok {
+		return max
+	}
+
+	sleep := time.Until(next)
+	if sleep < 0 {
+		sleep = 0
+	}
+	if sleep > max {
+		sleep = max
+	}
+	return sleep
+}
+
 func trimstrings(in []string) []string {
 	out := make([]string, len(in))
 	for i, s := range in {
@@ -103,14 +499,17 @@ func trimstrings(in []string) []string {
 	return out
 }
 
+func (e *env) Domains() []string {
+	return trimstrings(strings.Split(e.MailDomains, ","))
+}
+
 func (e *env) DefaultDomain() string {
-	domains := trimstrings(strings.Split(e.MailDomains, ","))
-	return domains[0]
+	return e.Domains()[0]
 }
 
 func buildMailers(env *env) map[string]*mail.Mailer {
 
-	domains := trimstrings(strings.Split(env.MailDomains, ","))
+	domains := env.Domains()
 	mailers := make(map[string]*mail.Mailer)
 
 	for _, mailDomain := range domains {
@@ -125,35 +524,361 @@ func buildMailers(env *env) map[string]*mail.Mailer {
 	return mailers
 }
 
-func main() {
-	env, err := setupEnv()
+/* DATASTORE=memory runs without a database, for dev. Nothing is kept */
+func openDatastore(e *env) (mail.Datastore, error) {
+	if e.DevStore {
+		if e.IsProd {
+			return nil, fmt.Errorf("DATASTORE=memory isn't for PROD")
+		}
+		slog.Warn("Using the in-memory datastore, nothing will be saved!")
+		return mail.MemStoreNew(), nil
+	}
 
+	ds, err := mail.SQLiteStoreNew(e.DbName)
 	if err != nil {
-		fmt.Printf("Unable to setup env %s\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	ds, err := mail.DatastoreNew(env.DbName)
+	if e.EncryptionKeys != "" {
+		ds.Keys, err = mail.ParseKeyring(e.EncryptionKeys, e.EncryptionKeyID)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: %s", err)
+		}
+		slog.Info("Encrypting mail at rest", "key_id", ds.Keys.Current())
+	}
+	return ds, nil
+}
+
+/* mailer migrate status|up|down [steps]|vacuum */
+func migrate(e *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status|up|down [steps]|vacuum")
+	}
+
+	mg, err := mail.MigratorNew(e.DbName)
 	if err != nil {
-		fmt.Printf("Unable to setup db %s\n", err)
-		os.Exit(1)
+		return err
+	}
+	defer mg.Close()
+
+	switch args[0] {
+	case "status":
+		status, err := mg.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := ""
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			undo := ""
+			if !s.CanUndo {
+				undo = "(no down)"
+			}
+			fmt.Printf("%4d  %-38s %-8s %-21s %s\n", s.Version, s.Name, s.State, applied, undo)
+		}
+	case "up":
+		count, err := mg.Up()
+		fmt.Printf("Applied %d migrations\n", count)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			val, err := strconv.ParseInt(args[1], 10, 32)
+			if err != nil || val < 1 {
+				return fmt.Errorf("steps must be a positive number")
+			}
+			steps = int(val)
+		}
+		count, err := mg.Down(steps)
+		fmt.Printf("Undid %d migrations\n", count)
+		return err
+	case "vacuum":
+		switched, err := mg.EnableIncrementalVacuum()
+		if err != nil {
+			return err
+		}
+		if switched {
+			fmt.Println("Switched to incremental vacuum")
+		} else {
+			fmt.Println("Already using incremental vacuum")
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %s", args[0])
+	}
+	return nil
+}
+
+/* mailer backup [-gzip] <file>. Safe to run alongside the mailer */
+func backup(e *env, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	gzipped := flags.Bool("gzip", false, "gzip the snapshot")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: backup [-gzip] <file>")
+	}
+	path := flags.Arg(0)
+
+	/* Don't leave a partial snapshot where a good one is expected */
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+
+	err = mail.BackupDatabase(e.DbName, f, *gzipped)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path + ".tmp", path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backed up %s to %s\n", e.DbName, path)
+	return nil
+}
+
+/* mailer restore <file>. Stop the mailer first */
+func restore(e *env, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: restore <file>")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = mail.Restore(e.DbName, f); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s from %s, the old database is at %s.pre-restore\n", e.DbName, args[0], e.DbName)
+	return nil
+}
+
+/* A date, a date and time (RFC 3339) or a unix time */
+func parseWhen(when string) (time.Time, error) {
+	if val, err := strconv.ParseInt(when, 10, 64); err == nil {
+		return time.Unix(val, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, when); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", when)
+}
+
+/* mailer export [-state s] [-job k] [-missive m] [-from t] [-to t] [file]
+ * Writes to stdout if there's no file */
+func export(e *env, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	getFilter := filterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	filter, err := getFilter()
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if flags.NArg() > 0 {
+		if out, err = os.Create(flags.Arg(0)); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+
+	exported, skipped, err := mail.ExportMails(ds, filter, out)
+	if err != nil {
+		return err
+	}
+
+	/* stdout may be the export */
+	fmt.Fprintf(os.Stderr, "Exported %d mails, skipped %d with no contents left\n", exported, skipped)
+	return nil
+}
+
+/* mailer import [file]. Reads stdin if there's no file */
+func importMails(e *env, args []string) error {
+	in := os.Stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return err
+	}
+
+	imported, skipped, err := mail.ImportMails(ds, in)
+	fmt.Printf("Imported %d mails, skipped %d we already had\n", imported, skipped)
+	return err
+}
+
+/* Run as mailer <command> ...; with no command, it serves */
+var commands = map[string]func(*env, []string) error{
+	"serve": serve,
+	"worker": workerOnly,
+	"api": apiOnly,
+	"schedule": schedule,
+	"list": list,
+	"show": show,
+	"cancel": cancel,
+	"retry": retry,
+	"config": config,
+	"attach": attach,
+	"migrate": migrate,
+	"backup": backup,
+	"restore": restore,
+	"export": export,
+	"import": importMails,
+}
+
+/* mailer serve: the API and the worker, together */
+func serve(e *env, args []string) error {
+	return run(e, true, true)
+}
+
+/* mailer worker: sends mail, with no HTTP */
+func workerOnly(e *env, args []string) error {
+	return run(e, false, true)
+}
+
+/* mailer api: takes mail, but leaves sending it to a worker elsewhere */
+func apiOnly(e *env, args []string) error {
+	return run(e, true, false)
+}
+
+/* Serve the API, run the worker (and its housekeeping), or both,
+ * until SIGINT/SIGTERM */
+func run(e *env, api bool, worker bool) error {
+	if api && e.IsProd && e.MetricsToken == "" {
+		return fmt.Errorf("METRICS_TOKEN must be set in PROD, or /metrics is open")
+	}
+
+	ds, err := openDatastore(e)
+	if err != nil {
+		return fmt.Errorf("Unable to setup db: %s", err)
+	}
+
+	/* Stop on SIGINT/SIGTERM */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	waker := mail.NewWaker()
+	workerDone := make(chan struct{})
+
+	/* Without a worker here, there's no worker health to report */
+	var health *mail.WorkerHealth
+	if worker {
+		slog.Info("Mailer domains", "domains", e.MailDomains)
+		mailers := buildMailers(e)
+		if _, ok := mailers[e.DefaultDomain()]; !ok {
+			return fmt.Errorf("No mailer for the default domain %s", e.DefaultDomain())
+		}
+
+		health = mail.NewWorkerHealth(e.StallAfter)
+		go func() {
+			superviseWorker(ctx, e, ds, mailers, waker, health)
+			close(workerDone)
+		}()
+		go janitor(ctx, e, ds)
+	} else {
+		close(workerDone)
 	}
 
-	fmt.Println("The Mailer Domain options are:", env.MailDomains)
+	if !api {
+		<-ctx.Done()
+		slog.Info("Shutting down, waiting for in-flight work")
+		<-workerDone
+		return nil
+	}
 
-	/* Start up the mail worker */
-	mailers := buildMailers(env)
-	go mailWorker(env, ds, mailers)
+	var dash *mail.Dashboard
+	if e.DashboardPassword != "" {
+		dash, err = mail.DashboardNew(ds, e.DashboardUser, e.DashboardPassword, e.Secret, waker)
+		if err != nil {
+			return fmt.Errorf("Unable to set up dashboard: %s", err)
+		}
+		slog.Info("Dashboard is up at /admin", "user", e.DashboardUser)
+	}
 
 	/* Listen for incoming mail requests */
 	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", "", env.Port),
-		Handler: mail.SetupRoutes(ds, env.Secret),
+		Addr:    fmt.Sprintf("%s:%s", "", e.Port),
+		Handler: mail.SetupRoutes(ds, e.Secret, e.MetricsToken, e.AttachmentPolicy, waker, health, dash),
 	}
 
-	fmt.Printf("Starting application on port %s\n", env.Port)
-	err = srv.ListenAndServe()
-	if err != nil {
+	srvErr := make(chan error, 1)
+	go func() {
+		slog.Info("Starting application", "port", e.Port)
+		srvErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-srvErr:
+		stop()
+		<-workerDone
+		return fmt.Errorf("Server stopped: %s", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for in-flight work")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+	defer cancel()
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Unable to shut down http server cleanly", "err", err)
+	}
+	<-workerDone
+	return nil
+}
+
+/* Commands that run without the mailer's env (and get a nil one) */
+var standalone = map[string]bool{
+	"attach": true,
+}
+
+func main() {
+	name, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Printf("Unknown command %s\n", name)
+		os.Exit(1)
+	}
+
+	var e *env
+	var err error
+	if !standalone[name] {
+		if e, err = setupEnv(); err != nil {
+			slog.Error("Unable to setup env", "err", err)
+			os.Exit(1)
+		}
+		slog.SetDefault(mail.NewLogger(os.Stderr, e.LogLevel, e.LogJSON))
+	}
+
+	if err = cmd(e, args); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -1,7 +1,10 @@
 { pkgs ? (
     let
       inherit (builtins) fetchTree fromJSON readFile;
-      inherit ((fromJSON (readFile ./flake.lock)).nodes) nixpkgs gomod2nix;
+      inherit (fromJSON (readFile ./flake.lock)) nodes;
+      # Whatever the flake's own nixpkgs input is locked to
+      nixpkgs = nodes.${nodes.root.inputs.nixpkgs};
+      gomod2nix = nodes.${nodes.root.inputs.gomod2nix};
     in
     import (fetchTree nixpkgs.locked) {
       overlays = [
@@ -12,7 +15,7 @@
 }:
 
 let
-  goEnv = pkgs.mkGoEnv { pwd = ./.; };
+  goEnv = pkgs.mkGoEnv { pwd = ./.; go = pkgs.go_1_21; };
 in
 pkgs.mkShell {
   packages = [